@@ -0,0 +1,116 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// WriteBatch collects puts and deletes that are applied atomically by Commit.
+// Records of a batch share a batch ID and are followed by a commit record;
+// on recovery a batch without its commit record is discarded.
+type WriteBatch struct {
+	bitcask *Bitcask
+	ops     []batchOp
+}
+
+type batchOp struct {
+	key    string
+	value  []byte
+	delete bool
+}
+
+// NewWriteBatch creates an empty write batch for the Bitcask database.
+func (b *Bitcask) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{bitcask: b}
+}
+
+// Put adds a key-value pair to the batch.
+func (wb *WriteBatch) Put(key string, value []byte) {
+	v := make([]byte, len(value))
+	copy(v, value)
+	wb.ops = append(wb.ops, batchOp{key: key, value: v})
+}
+
+// Delete adds the removal of a key to the batch.
+func (wb *WriteBatch) Delete(key string) {
+	wb.ops = append(wb.ops, batchOp{key: key, delete: true})
+}
+
+// Len returns the number of operations in the batch.
+func (wb *WriteBatch) Len() int {
+	return len(wb.ops)
+}
+
+// Commit writes all operations of the batch atomically. The batch is reset
+// after a successful commit and may be reused.
+func (wb *WriteBatch) Commit() error {
+	b := wb.bitcask
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	ops := wb.ops
+	if err := b.commit(func() error { return b.commitBatch(ops) }); err != nil {
+		return err
+	}
+	wb.ops = nil
+	return nil
+}
+
+// commitBatch 将一组操作连同提交记录一次性写入活动文件，调用方需持有写锁
+func (b *Bitcask) commitBatch(ops []batchOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	timestamp := time.Now().UnixNano()
+	batchID := uint64(timestamp)
+
+	var data []byte
+	entries := make([]Entry, len(ops))
+	for i, op := range ops {
+		value := op.value
+		recordType := recordTypeTombstone
+		codec := CodecNone
+		if !op.delete {
+			var err error
+			if codec, value, err = b.encodeValue(value); err != nil {
+				return err
+			}
+			recordType = recordTypeValue
+		}
+
+		record := encodeRecord(recordHeader{timestamp: timestamp, recordType: recordType, codec: codec, batchID: batchID}, op.key, value)
+		entries[i] = Entry{
+			valueSize: int32(len(value)),
+			valuePos:  int64(len(data)) + headerSize + int64(len(op.key)),
+			timestamp: timestamp,
+		}
+		data = append(data, record...)
+	}
+
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, uint32(len(ops)))
+	data = append(data, encodeRecord(recordHeader{timestamp: timestamp, recordType: recordTypeBatchCommit, batchID: batchID}, "", count)...)
+
+	// 整个批次一次写入同一个数据文件
+	offset, err := b.write(data)
+	if err != nil {
+		return fmt.Errorf("failed to write batch: %w", err)
+	}
+
+	for i, op := range ops {
+		if op.delete {
+			b.deleteKey(op.key)
+			b.addTombstone(b.activeFileID, op.key)
+			continue
+		}
+		e := entries[i]
+		e.fileID = b.activeFileID
+		e.valuePos += offset
+		b.setKey(op.key, e)
+	}
+
+	return nil
+}
@@ -2,11 +2,9 @@ package bitcask
 
 import (
 	"bytes"
-	"compress/zlib"
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
@@ -14,215 +12,315 @@ import (
 )
 
 // Open opens a Bitcask database instance.
+// The directory is locked for exclusive use until Close is called; if another
+// process holds the lock, Open returns ErrDatabaseLocked. A database opened
+// with ReadOnly takes no lock and can inspect a directory in use by a writer.
 func Open(dir string, opts ...ConfOption) (*Bitcask, error) {
+	config := DefaultConfig()
+	for _, opt := range opts {
+		opt(config)
+	}
+	if err := config.SyncPolicy.validate(); err != nil {
+		return nil, err
+	}
+
+	// 自定义编码在打开数据库时自动注册
+	if config.Codec != nil {
+		if err := RegisterCodec(config.Codec); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ReadOnly {
+		return openReadOnly(dir, config)
+	}
+
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	config := DefaultConfig()
-	for _, opt := range opts {
-		opt(config)
+	lockFile, err := acquireLock(dir, config.LockTimeout)
+	if err != nil {
+		return nil, err
 	}
 
 	b := &Bitcask{
 		directory:   dir,
-		keydir:      make(map[string]entry),
+		keydir:      config.NewIndex(),
 		config:      config,
 		mmapedFiles: make(map[int64]*MmapedFile),
+		fileStat:    make(map[int64]*fileStat),
+		lockFile:    lockFile,
+		ioLimiter:   newRateLimiter(config.BackgroundIORate, config.BackgroundIOBurst),
+	}
+
+	if err := b.openFiles(); err != nil {
+		b.closeFiles()
+		releaseLock(lockFile)
+		return nil, err
+	}
+
+	b.startMerger()
+	b.startSyncer()
+
+	return b, nil
+}
+
+// openReadOnly 以只读方式打开数据库：只加载现有的数据文件，不创建活动文件，也不启动合并
+func openReadOnly(dir string, config *Config) (*Bitcask, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("failed to open directory: %w", err)
+	}
+
+	b := &Bitcask{
+		directory:   dir,
+		keydir:      config.NewIndex(),
+		config:      config,
+		mmapedFiles: make(map[int64]*MmapedFile),
+		fileStat:    make(map[int64]*fileStat),
+		ioLimiter:   newRateLimiter(config.BackgroundIORate, config.BackgroundIOBurst),
 	}
 
-	// 加载现有的数据文件
 	if err := b.loadExistingFiles(); err != nil {
+		b.closeFiles()
 		return nil, fmt.Errorf("failed to load existing files: %w", err)
 	}
 
+	return b, nil
+}
+
+// openFiles 加载现有的数据文件并打开活动文件
+func (b *Bitcask) openFiles() error {
+	// 完成或回退上次被中断的合并
+	if err := b.recoverMerge(); err != nil {
+		return fmt.Errorf("failed to recover merge: %w", err)
+	}
+
+	// 加载现有的数据文件
+	if err := b.loadExistingFiles(); err != nil {
+		return fmt.Errorf("failed to load existing files: %w", err)
+	}
+
 	// 如果没有现有的数据文件，创建一个新的
 	if b.activeFileID == 0 {
 		if err := b.openNewActiveFile(); err != nil {
-			return nil, fmt.Errorf("failed to open new active file: %w", err)
+			return fmt.Errorf("failed to open new active file: %w", err)
 		}
 	} else {
 		// 打开最后一个数据文件作为活动文件
 		if err := b.openActiveFile(b.activeFileID); err != nil {
-			return nil, fmt.Errorf("failed to open active file: %w", err)
-		}
-		// 更新内存映射
-		if err := b.updateMmap(b.activeFileID); err != nil {
-			return nil, fmt.Errorf("failed to update mmap: %w", err)
+			return fmt.Errorf("failed to open active file: %w", err)
 		}
 	}
 
-	go b.periodicMerge()
-
-	return b, nil
+	return nil
 }
 
 // Put inserts a key-value pair into the Bitcask database.
 func (b *Bitcask) Put(key string, value []byte) error {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
 
-	return b.put(key, value)
+	return b.commit(func() error {
+		return b.put(key, value, 0)
+	})
 }
 
-func (b *Bitcask) put(key string, value []byte) error {
+// put 写入key的新值，ttl大于0时值在ttl之后过期，调用方需持有写锁
+func (b *Bitcask) put(key string, value []byte, ttl time.Duration) error {
+	codec, value, err := b.encodeValue(value)
+	if err != nil {
+		return err
+	}
+
 	timestamp := time.Now().UnixNano()
-	keySize := len(key)
-	valueSize := len(value)
-
-	if b.config.CompressData {
-		var buf bytes.Buffer
-		w := zlib.NewWriter(&buf)
-		if _, err := w.Write(value); err != nil {
-			return fmt.Errorf("failed to compress data: %w", err)
-		}
-		w.Close()
-		value = buf.Bytes()
-		valueSize = len(value)
+	return b.writeValue(key, recordHeader{timestamp: timestamp, recordType: recordTypeValue, codec: codec, expiry: expiryAt(timestamp, ttl)}, value)
+}
+
+// writeValue 把已编码的值写入活动文件并更新keydir，调用方需持有写锁
+func (b *Bitcask) writeValue(key string, h recordHeader, value []byte) error {
+	data := encodeRecord(h, key, value)
+
+	offset, err := b.write(data)
+	if err != nil {
+		return err
 	}
 
-	header := make([]byte, headerSize)
-	binary.BigEndian.PutUint64(header[4:], uint64(timestamp))
-	binary.BigEndian.PutUint32(header[12:], uint32(keySize))
-	binary.BigEndian.PutUint32(header[16:], uint32(valueSize))
+	b.setKey(key, Entry{
+		fileID:    b.activeFileID,
+		valueSize: int32(len(value)),
+		valuePos:  offset + headerSize + int64(len(key)),
+		timestamp: h.timestamp,
+		expiry:    h.expiry,
+	})
 
-	crc := crc32.ChecksumIEEE(append([]byte(key), value...))
-	binary.BigEndian.PutUint32(header[:4], crc)
+	return nil
+}
 
-	totalSize := int64(headerSize) + int64(keySize) + int64(valueSize)
+// write 将编码好的记录追加到活动文件，返回写入的起始位置
+func (b *Bitcask) write(data []byte) (int64, error) {
+	size := b.activeFileSize()
 
 	// 检查是否需要创建新文件
-	if b.activeFile == nil || b.getActiveFileSize()+totalSize > b.config.MaxFileSize {
-		if err := b.openNewActiveFile(); err != nil {
-			return fmt.Errorf("failed to open new active file: %w", err)
-		}
-		// 创建新的hint文件
-		hintFilename := b.getHintFilePath(b.activeFileID)
-		hintFile, err := os.Create(hintFilename)
-		if err != nil {
-			return fmt.Errorf("failed to create hint file: %w", err)
-		}
-		defer hintFile.Close()
-
-		// 将当前keydir中的所有条目写入新的hint文件
-		for k, e := range b.keydir {
-			if err := b.writeHintEntry(hintFile, k, e); err != nil {
-				return fmt.Errorf("failed to write hint entry: %w", err)
-			}
+	if b.activeFile == nil || (size > fileHeaderSize && size+int64(len(data)) > b.config.MaxFileSize) {
+		if err := b.rotateActiveFile(); err != nil {
+			return 0, fmt.Errorf("failed to open new active file: %w", err)
 		}
+		size = fileHeaderSize
 	}
 
-	valuePos, err := b.activeFile.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return fmt.Errorf("failed to get file position: %w", err)
+	// 先写入缓冲，再按同步策略写入文件和落盘
+	b.writeBuf = append(b.writeBuf, data...)
+	b.stat(b.activeFileID).size += int64(len(data))
+	if err := b.afterWrite(len(data)); err != nil {
+		return 0, err
 	}
 
-	// 写入数据
-	if _, err := b.activeFile.Write(header); err != nil {
-		return fmt.Errorf("failed to write header: %w", err)
+	return size, nil
+}
+
+// Get retrieves the value associated with a given key from the Bitcask database.
+// Expired keys are reported as ErrKeyNotFound. The returned slice is a copy owned by the caller. Use View to read a value
+// without copying it.
+func (b *Bitcask) Get(key string) ([]byte, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.get(key)
+}
+
+// View calls fn with the value associated with key without copying it. The
+// slice is only valid until fn returns and must not be modified. fn runs
+// without holding the database lock, so it may call other methods.
+func (b *Bitcask) View(key string, fn func(value []byte) error) error {
+	b.mutex.RLock()
+	if b.closed {
+		b.mutex.RUnlock()
+		return ErrClosed
 	}
-	if _, err := b.activeFile.Write([]byte(key)); err != nil {
-		return fmt.Errorf("failed to write key: %w", err)
+	e, ok := b.keydir.Get(key)
+	if !ok || e.expired(time.Now().UnixNano()) {
+		b.mutex.RUnlock()
+		return ErrKeyNotFound
 	}
-	if _, err := b.activeFile.Write(value); err != nil {
-		return fmt.Errorf("failed to write value: %w", err)
+	h, value, err := b.readRecord(key, e)
+	if err != nil {
+		b.mutex.RUnlock()
+		return err
 	}
-
-	if b.config.SyncWrites {
-		if err := b.activeFile.Sync(); err != nil {
-			return fmt.Errorf("failed to sync file: %w", err)
-		}
+	// 还在写缓冲中的值在释放锁之后可能被覆盖，复制一份
+	if b.buffered(e) {
+		value = append([]byte(nil), value...)
 	}
+	// 持有映射的引用，回调执行期间即使文件被重新映射或合并删除，value也仍然有效
+	mf := b.mmapedFiles[e.fileID]
+	mf.acquire()
+	b.mutex.RUnlock()
+	defer mf.release()
 
-	b.keydir[key] = entry{
-		fileID:    b.activeFileID,
-		valueSize: int32(valueSize),
-		valuePos:  valuePos + headerSize + int64(keySize),
-		timestamp: timestamp,
+	value, err = decodeValue(h.codec, value)
+	if err != nil {
+		return err
 	}
+	return fn(value)
+}
 
-	// 更新内存映射
-	if err := b.updateMmap(b.activeFileID); err != nil {
-		return fmt.Errorf("failed to update mmap: %w", err)
+// get 读取key对应的值，调用方需持有锁
+func (b *Bitcask) get(key string) ([]byte, error) {
+	if b.closed {
+		return nil, ErrClosed
+	}
+	e, ok := b.keydir.Get(key)
+	if !ok || e.expired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
 	}
 
-	return nil
-}
-
-// Get retrieves the value associated with a given key from the Bitcask database.
-func (b *Bitcask) Get(key string) ([]byte, error) {
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
+	h, value, err := b.readRecord(key, e)
+	if err != nil {
+		return nil, err
+	}
 
-	e, ok := b.keydir[key]
-	if !ok {
-		return nil, ErrKeyNotFound
+	// 没有压缩的值直接指向内存映射，复制一份再返回，映射解除之后返回值仍然有效
+	if h.codec == CodecNone {
+		return append([]byte(nil), value...), nil
 	}
+	// 按记录中保存的编码解码
+	return decodeValue(h.codec, value)
+}
 
+// readRecord 从内存映射或写缓冲中读取e指向的记录，返回记录头和未解码的值
+func (b *Bitcask) readRecord(key string, e Entry) (recordHeader, []byte, error) {
 	mf, ok := b.mmapedFiles[e.fileID]
 	if !ok {
-		return nil, fmt.Errorf("mmap file not found for file ID %d", e.fileID)
+		return recordHeader{}, nil, fmt.Errorf("mmap file not found for file ID %d", e.fileID)
 	}
 
-	if e.valuePos+int64(e.valueSize) > int64(len(mf.data)) {
-		return nil, fmt.Errorf("value position out of range")
+	// 记录总是整条写入缓冲和文件，不会一部分在文件中一部分在缓冲中
+	if b.buffered(e) {
+		return b.recordAt(b.writeBuf, mf.size, key, e)
 	}
+	return b.recordAt(mf.data[:mf.size], 0, key, e)
+}
 
-	value := mf.data[e.valuePos : e.valuePos+int64(e.valueSize)]
-
-	if b.config.CompressData {
-		r, err := zlib.NewReader(bytes.NewReader(value))
-		if err != nil {
-			return nil, fmt.Errorf("failed to create zlib reader: %w", err)
-		}
-		defer r.Close()
+// recordAt 从data中取出e指向的记录并校验CRC，base是data在文件中的起始位置
+func (b *Bitcask) recordAt(data []byte, base int64, key string, e Entry) (recordHeader, []byte, error) {
+	offset := e.valuePos - headerSize - int64(len(key)) - base
+	end := e.valuePos + int64(e.valueSize) - base
+	if offset < 0 || end > int64(len(data)) {
+		return recordHeader{}, nil, fmt.Errorf("value position out of range")
+	}
 
-		var buf bytes.Buffer
-		if _, err := io.Copy(&buf, r); err != nil {
-			return nil, fmt.Errorf("failed to decompress data: %w", err)
-		}
-		value = buf.Bytes()
+	// 校验整条记录的CRC
+	record := data[offset:end]
+	if b.config.VerifyChecksum && !validChecksum(record) {
+		return recordHeader{}, nil, &CorruptError{FileID: e.fileID, Offset: base + offset}
 	}
 
-	return value, nil
+	return decodeRecordHeader(record), record[headerSize+len(key):], nil
 }
 
 // Delete removes a key-value pair from the Bitcask database.
 func (b *Bitcask) Delete(key string) error {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
-	// 写入一个特殊的墓碑值
-	if err := b.put(key, []byte{}); err != nil {
-		return fmt.Errorf("failed to write tombstone: %w", err)
+	if b.config.ReadOnly {
+		return ErrReadOnly
 	}
 
-	// 从keydir中删除
-	delete(b.keydir, key)
-	return nil
+	return b.commit(func() error {
+		// 写入墓碑记录，恢复和合并时据此识别删除
+		data := encodeRecord(recordHeader{timestamp: time.Now().UnixNano(), recordType: recordTypeTombstone}, key, nil)
+		if _, err := b.write(data); err != nil {
+			return fmt.Errorf("failed to write tombstone: %w", err)
+		}
+		b.addTombstone(b.activeFileID, key)
+
+		// 从keydir中删除
+		b.deleteKey(key)
+		return nil
+	})
 }
 
-// BatchPut inserts multiple key-value pairs into the Bitcask database.
+// BatchPut atomically inserts multiple key-value pairs into the Bitcask database.
+// Either all pairs become visible, including after a crash, or none do.
 func (b *Bitcask) BatchPut(pairs map[string][]byte) error {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
+	wb := b.NewWriteBatch()
 	for key, value := range pairs {
-		if err := b.put(key, value); err != nil {
-			return fmt.Errorf("failed to put key %s: %w", key, err)
-		}
+		wb.Put(key, value)
 	}
-	return nil
+	return wb.Commit()
 }
 
 // BatchGet retrieves multiple key-value pairs from the Bitcask database.
 func (b *Bitcask) BatchGet(keys []string) (map[string][]byte, error) {
 	b.mutex.RLock()
 	defer b.mutex.RUnlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
 
 	result := make(map[string][]byte)
 	for _, key := range keys {
-		value, err := b.Get(key)
+		value, err := b.get(key)
 		if err == nil {
 			result[key] = value
 		} else if !errors.Is(err, ErrKeyNotFound) {
@@ -232,44 +330,47 @@ func (b *Bitcask) BatchGet(keys []string) (map[string][]byte, error) {
 	return result, nil
 }
 
-// Iterator creates an iterator over the key-value pairs in the Bitcask database.
-func (b *Bitcask) Iterator() *Iterator {
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
-
-	keys := make([]string, 0, len(b.keydir))
-	for k := range b.keydir {
-		keys = append(keys, k)
-	}
-
-	return &Iterator{
-		bitcask: b,
-		keys:    keys,
-		index:   0,
-	}
-}
-
 // Snapshot creates a snapshot of the current state of the Bitcask database.
+// Reads, writes and merges continue while the files are copied; the copy is
+// throttled by BackgroundIORate.
 func (b *Bitcask) Snapshot(snapshotDir string) error {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
 	if err := os.MkdirAll(snapshotDir, 0755); err != nil {
 		return fmt.Errorf("failed to create snapshot directory: %w", err)
 	}
 
-	for fileID := range b.mmapedFiles {
+	// 先把写缓冲写入文件，再持有当前映射的引用，复制期间文件被合并删除或重新映射也不受影响
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return ErrClosed
+	}
+	if !b.config.ReadOnly && b.activeFile != nil {
+		if err := b.flush(); err != nil {
+			b.mutex.Unlock()
+			return err
+		}
+	}
+	files := b.pinFiles()
+	sizes := make(map[int64]int64, len(files))
+	for fileID, mf := range files {
+		sizes[fileID] = mf.size
+	}
+	b.mutex.Unlock()
+	defer unpinFiles(files)
+
+	for fileID, mf := range files {
 		srcPath := b.getDataFilePath(fileID)
 		dstPath := filepath.Join(snapshotDir, filepath.Base(srcPath))
 
-		if err := b.copyFile(srcPath, dstPath); err != nil {
+		if err := b.writeSnapshotFile(dstPath, mf.data[:sizes[fileID]]); err != nil {
 			return fmt.Errorf("failed to copy data file: %w", err)
 		}
 
+		// 活动文件和刚被合并的文件可能没有hint文件，打开快照时会从数据文件重建
 		hintSrcPath := b.getHintFilePath(fileID)
 		hintDstPath := filepath.Join(snapshotDir, filepath.Base(hintSrcPath))
 
-		if err := b.copyFile(hintSrcPath, hintDstPath); err != nil {
+		if err := b.copyFile(hintSrcPath, hintDstPath); err != nil && !os.IsNotExist(err) {
 			return fmt.Errorf("failed to copy hint file: %w", err)
 		}
 	}
@@ -277,34 +378,73 @@ func (b *Bitcask) Snapshot(snapshotDir string) error {
 	return nil
 }
 
+// writeSnapshotFile 把映射中的数据写入快照文件，写入速度受后台I/O限速控制
+func (b *Bitcask) writeSnapshotFile(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(&limitedWriter{ctx: context.Background(), w: file, limiter: b.ioLimiter}, bytes.NewReader(data))
+	return err
+}
+
 // Close closes the Bitcask database, ensuring all files are properly closed and memory maps are unmapped.
+// It stops background merging and waits for a running merge to finish first.
+// Afterwards all reads and writes, and further calls to Close, return ErrClosed.
 func (b *Bitcask) Close() error {
+	// 停止后台合并，并等待正在进行的合并结束
+	if b.stopMerge != nil {
+		b.stopMerge()
+		b.mergeWG.Wait()
+	}
+	if b.stopSync != nil {
+		b.stopSync()
+		b.syncWG.Wait()
+	}
+	// closed在合并锁和读写锁下设置，合并和读写都能看到
+	b.mergeMutex.Lock()
+	defer b.mergeMutex.Unlock()
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	b.closed = true
+
+	if b.config.ReadOnly {
+		return b.closeFiles()
+	}
+	defer releaseLock(b.lockFile)
 
 	if b.activeFile != nil {
-		// 创建最后的hint文件
-		hintFilename := b.getHintFilePath(b.activeFileID)
-		hintFile, err := os.Create(hintFilename)
-		if err != nil {
+		// 写缓冲中的记录落盘之后为活动文件生成最后的hint文件
+		if err := b.syncActiveFile(); err != nil {
+			b.closeFiles()
+			return err
+		}
+		if err := b.sealActiveFile(); err != nil {
+			b.closeFiles()
 			return fmt.Errorf("failed to create final hint file: %w", err)
 		}
-		defer hintFile.Close()
+	}
 
-		// 将当前keydir中的所有条目写入hint文件
-		for k, e := range b.keydir {
-			if err := b.writeHintEntry(hintFile, k, e); err != nil {
-				return fmt.Errorf("failed to write final hint entry: %w", err)
-			}
-		}
+	return b.closeFiles()
+}
 
+// closeFiles 关闭活动文件并解除所有内存映射
+func (b *Bitcask) closeFiles() error {
+	if b.activeFile != nil {
 		if err := b.activeFile.Close(); err != nil {
 			return fmt.Errorf("failed to close active file: %w", err)
 		}
+		b.activeFile = nil
 	}
 
-	for _, mf := range b.mmapedFiles {
-		if err := b.unmmapFile(mf); err != nil {
+	// 仍被迭代器或快照引用的映射在它们释放之后才解除
+	for fileID := range b.mmapedFiles {
+		if err := b.removeMmap(fileID); err != nil {
 			return fmt.Errorf("failed to unmap file: %w", err)
 		}
 	}
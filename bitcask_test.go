@@ -2,52 +2,75 @@ package bitcask
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestConcurrentOperations(t *testing.T) {
-	dir, err := os.MkdirTemp("", "bitcask-test")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.RemoveAll(dir)
+	for _, syncWrites := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SyncWrites=%v", syncWrites), func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "bitcask-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
 
-	db, err := Open(dir)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer db.Close()
+			db, err := Open(dir, SyncWrites(syncWrites))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
 
-	const numOps = 1000
-	const numGoroutines = 10
+			const numOps = 1000
+			const numGoroutines = 10
 
-	var wg sync.WaitGroup
-	for i := 0; i < numGoroutines; i++ {
-		wg.Add(1)
-		go func(id int) {
-			defer wg.Done()
-			for j := 0; j < numOps; j++ {
-				key := fmt.Sprintf("key-%d-%d", id, j)
-				value := []byte(fmt.Sprintf("value-%d-%d", id, j))
+			start := time.Now()
+			var wg sync.WaitGroup
+			for i := 0; i < numGoroutines; i++ {
+				wg.Add(1)
+				go func(id int) {
+					defer wg.Done()
+					for j := 0; j < numOps; j++ {
+						key := fmt.Sprintf("key-%d-%d", id, j)
+						value := []byte(fmt.Sprintf("value-%d-%d", id, j))
 
-				err := db.Put(key, value)
-				if err != nil {
-					t.Errorf("Put failed: %v", err)
-				}
+						err := db.Put(key, value)
+						if err != nil {
+							t.Errorf("Put failed: %v", err)
+						}
 
-				_, err = db.Get(key)
-				if err != nil {
-					t.Errorf("Get failed: %v", err)
-				}
+						_, err = db.Get(key)
+						if err != nil {
+							t.Errorf("Get failed: %v", err)
+						}
+					}
+				}(i)
 			}
-		}(i)
-	}
 
-	wg.Wait()
+			wg.Wait()
+
+			syncs := db.Stats().Syncs
+			t.Logf("%d puts in %v with %d fsyncs", numOps*numGoroutines, time.Since(start), syncs)
+			// 并发写入组提交，落盘次数少于写入次数
+			if syncWrites && syncs >= numOps*numGoroutines {
+				t.Errorf("expected concurrent puts to share fsyncs, got %d fsyncs for %d puts", syncs, numOps*numGoroutines)
+			}
+		})
+	}
 }
 
 func BenchmarkPut(b *testing.B) {
@@ -74,6 +97,42 @@ func BenchmarkPut(b *testing.B) {
 	}
 }
 
+func BenchmarkPutSyncParallel(b *testing.B) {
+	dir, err := os.MkdirTemp("", "bitcask-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, SyncWrites(true))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	var n int64
+	var mu sync.Mutex
+	// 模拟大量并发写者，I/O等待不占用CPU
+	b.SetParallelism(16)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mu.Lock()
+			n++
+			i := n
+			mu.Unlock()
+
+			key := fmt.Sprintf("key-%d", i)
+			value := []byte(fmt.Sprintf("value-%d", i))
+			if err := db.Put(key, value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.ReportMetric(float64(db.Stats().Syncs)/float64(b.N), "fsyncs/op")
+}
+
 func BenchmarkGet(b *testing.B) {
 	dir, err := os.MkdirTemp("", "bitcask-bench")
 	if err != nil {
@@ -257,3 +316,2641 @@ func TestDataConsistency(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("stale", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	wb := db.NewWriteBatch()
+	wb.Put("a", []byte("1"))
+	wb.Put("b", []byte("2"))
+	wb.Delete("stale")
+	if err := wb.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if wb.Len() != 0 {
+		t.Errorf("batch not reset after commit, len %d", wb.Len())
+	}
+	if _, err := db.Get("stale"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected deleted key to be missing, got %v", err)
+	}
+	db.Close()
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		value, err := db.Get(key)
+		if err != nil {
+			t.Fatalf("Get %s failed: %v", key, err)
+		}
+		if string(value) != want {
+			t.Errorf("Unexpected value for key %s. Got %s, want %s", key, value, want)
+		}
+	}
+	if _, err := db.Get("stale"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected deleted key to stay missing after reopen, got %v", err)
+	}
+}
+
+func TestUncommittedBatchDiscarded(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("before", []byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BatchPut(map[string][]byte{"x": []byte("1"), "y": []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+	dataPath := db.getDataFilePath(db.activeFileID)
+	hintPath := db.getHintFilePath(db.activeFileID)
+	db.Close()
+
+	// 模拟在写入提交记录之前崩溃：截掉提交记录并删除hint文件
+	info, err := os.Stat(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(dataPath, info.Size()-headerSize-4); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(hintPath); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get("before"); err != nil {
+		t.Errorf("Get before failed: %v", err)
+	}
+	for _, key := range []string{"x", "y"} {
+		if _, err := db.Get(key); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("expected key %s from uncommitted batch to be missing, got %v", key, err)
+		}
+	}
+}
+
+func TestDeleteTombstoneRecovery(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("deleted", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("empty", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	check := func(db *Bitcask) {
+		t.Helper()
+		if _, err := db.Get("deleted"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("expected deleted key to be missing, got %v", err)
+		}
+		value, err := db.Get("empty")
+		if err != nil {
+			t.Errorf("Get empty failed: %v", err)
+		}
+		if len(value) != 0 {
+			t.Errorf("expected empty value, got %q", value)
+		}
+	}
+
+	// 第一次通过hint文件恢复
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	db.Close()
+
+	// 删除hint文件，从数据文件重建
+	hints, err := filepath.Glob(filepath.Join(dir, "*.hint"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hint := range hints {
+		os.Remove(hint)
+	}
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestMerge(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, MaxDatafileSize(1024), MergeThreshold(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i += 2 {
+		if err := db.Delete(fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := db.Merge(context.Background(), MergeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 合并之后的写入必须在恢复时覆盖合并文件中的值
+	if err := db.Put("key-1", []byte("updated")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key-3"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		value, err := db.Get(key)
+		switch {
+		case i == 1:
+			if string(value) != "updated" {
+				t.Errorf("Unexpected value for key %s. Got %s, want updated", key, value)
+			}
+		case i%2 == 0 || i == 3:
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("expected key %s to be deleted, got %v", key, err)
+			}
+		default:
+			if err != nil {
+				t.Errorf("Get failed for key %s: %v", key, err)
+			}
+			if string(value) != fmt.Sprintf("value-%d", i) {
+				t.Errorf("Unexpected value for key %s. Got %s", key, value)
+			}
+		}
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 翻转值中的一个字节
+	f, err := os.OpenFile(db.getDataFilePath(db.activeFileID), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("V"), fileHeaderSize+headerSize+int64(len("key"))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	_, err = db.Get("key")
+	var corruptErr *CorruptError
+	if !errors.Is(err, ErrCorrupt) || !errors.As(err, &corruptErr) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	if corruptErr.FileID != db.activeFileID || corruptErr.Offset != fileHeaderSize {
+		t.Errorf("unexpected corrupt location: file %d offset %d", corruptErr.FileID, corruptErr.Offset)
+	}
+
+	db.config.VerifyChecksum = false
+	value, err := db.Get("key")
+	if err != nil {
+		t.Fatalf("Get without verification failed: %v", err)
+	}
+	if string(value) != "Value" {
+		t.Errorf("Unexpected value. Got %s, want Value", value)
+	}
+}
+
+func TestTornWriteRecovery(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dataPath := db.getDataFilePath(db.activeFileID)
+	hintPath := db.getHintFilePath(db.activeFileID)
+	db.Close()
+
+	info, err := os.Stat(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validSize := info.Size()
+
+	// 模拟put写到一半时崩溃：只追加半条记录，并且没有hint文件
+	record := encodeRecord(recordHeader{timestamp: 1}, "torn", []byte("partial value"))
+	f, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(record[:len(record)/2]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.Remove(hintPath); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	db, err = Open(dir, Logger(log.New(&logs, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		value, err := db.Get(key)
+		if err != nil {
+			t.Errorf("Get failed for key %s: %v", key, err)
+		}
+		if string(value) != fmt.Sprintf("value-%d", i) {
+			t.Errorf("Unexpected value for key %s. Got %s", key, value)
+		}
+	}
+	if _, err := db.Get("torn"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected torn key to be missing, got %v", err)
+	}
+
+	info, err = os.Stat(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != validSize {
+		t.Errorf("data file not truncated: size %d, want %d", info.Size(), validSize)
+	}
+	quarantined, err := filepath.Glob(filepath.Join(dir, "*.torn"))
+	if err != nil || len(quarantined) != 1 {
+		t.Errorf("expected one quarantine file, got %v (%v)", quarantined, err)
+	}
+	if logs.Len() == 0 {
+		t.Error("expected discarded tail to be logged")
+	}
+
+	// 截断之后可以继续正常写入
+	if err := db.Put("after", []byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("after"); err != nil || string(value) != "ok" {
+		t.Errorf("Get after recovery failed: %s, %v", value, err)
+	}
+	hintPath = db.getHintFilePath(db.activeFileID)
+	db.Close()
+
+	// Logger(nil)关闭日志，恢复时也不能panic
+	f, err = os.OpenFile(dataPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("xyz")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.Remove(hintPath); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, Logger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("after"); err != nil || string(value) != "ok" {
+		t.Errorf("Get after silent recovery failed: %s, %v", value, err)
+	}
+}
+
+func TestCorruptMiddleRecord(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dataPath := db.getDataFilePath(db.activeFileID)
+	hintPath := db.getHintFilePath(db.activeFileID)
+	db.Close()
+
+	// 损坏最新数据文件中间的一条记录，之后的记录都是完整的
+	recordLen := int64(headerSize + len("key-0") + len("value-0"))
+	f, err := os.OpenFile(dataPath, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("V"), fileHeaderSize+3*recordLen+headerSize+int64(len("key-3"))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.Remove(hintPath); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(dir)
+	var corruptErr *CorruptError
+	if !errors.Is(err, ErrCorrupt) || !errors.As(err, &corruptErr) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	if corruptErr.Offset != fileHeaderSize+3*recordLen {
+		t.Errorf("unexpected corrupt offset %d", corruptErr.Offset)
+	}
+
+	after, err := os.Stat(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() != info.Size() {
+		t.Errorf("data file truncated from %d to %d bytes", info.Size(), after.Size())
+	}
+	if quarantined, _ := filepath.Glob(filepath.Join(dir, "*.torn")); len(quarantined) != 0 {
+		t.Errorf("expected no quarantine file, got %v", quarantined)
+	}
+}
+
+func TestDirectoryLock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(dir); !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("expected ErrDatabaseLocked, got %v", err)
+	}
+	if _, err := Open(dir, LockTimeout(50*time.Millisecond)); !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("expected ErrDatabaseLocked after timeout, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		db.Close()
+	}()
+
+	// 等待第一个实例释放锁
+	db2, err := Open(dir, LockTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("Open with lock timeout failed: %v", err)
+	}
+	db2.Close()
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("deleted", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	// 只读实例只能看到已经写入文件的记录
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 只读实例可以和写入实例同时打开同一个目录
+	ro, err := Open(dir, ReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := ro.Get("key")
+	if err != nil || string(value) != "value" {
+		t.Errorf("Get from read-only instance failed: %s, %v", value, err)
+	}
+	if _, err := ro.Get("deleted"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected deleted key to be missing, got %v", err)
+	}
+	if err := ro.Put("key", []byte("other")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly from Put, got %v", err)
+	}
+	if err := ro.Delete("key"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly from Delete, got %v", err)
+	}
+	if err := ro.BatchPut(map[string][]byte{"a": []byte("1")}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly from BatchPut, got %v", err)
+	}
+
+	// 映射之后写入实例追加的记录不在映射范围内，重新扫描时也不能读到
+	if err := db.Put("later", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	err = ro.scanDataFile(ro.activeFileID, func(key string, hr hintRecord) error {
+		if hr.valuePos+int64(hr.valueSize) > ro.mmapedFiles[hr.fileID].size {
+			t.Errorf("record for %s at %d is past the mapped size", key, hr.valuePos)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("read-only instance changed the directory: %d files before, %d after", len(before), len(after))
+	}
+
+	if _, err := Open(filepath.Join(dir, "missing"), ReadOnly()); err == nil {
+		t.Error("expected read-only Open of a missing directory to fail")
+	}
+}
+
+func TestMigrateLegacyFormat(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 按没有文件头的旧格式写一个数据文件：4(crc) + 8(timestamp) + 4(keySize) + 4(valueSize)
+	var legacy bytes.Buffer
+	writeLegacy := func(key, value string) {
+		header := make([]byte, legacyHeaderSize)
+		binary.BigEndian.PutUint32(header[:4], crc32.ChecksumIEEE([]byte(key+value)))
+		binary.BigEndian.PutUint64(header[4:12], uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint32(header[12:16], uint32(len(key)))
+		binary.BigEndian.PutUint32(header[16:20], uint32(len(value)))
+		legacy.Write(header)
+		legacy.WriteString(key)
+		legacy.WriteString(value)
+	}
+	writeLegacy("key1", "value1")
+	writeLegacy("key2", "value2")
+	writeLegacy("key2", "") // 旧版本的删除
+	if err := os.WriteFile(filepath.Join(dir, "1000.data"), legacy.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 版本2的记录头没有过期时间：4(crc) + 8(timestamp) + 4(keySize) + 4(valueSize) + 1(type) + 1(codec) + 8(batchID)
+	v2 := bytes.NewBuffer(encodeFileHeader(fileHeader{version: 2, kind: fileKindData}))
+	record := make([]byte, 30+len("key3")+len("value3"))
+	binary.BigEndian.PutUint64(record[4:12], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(record[12:16], uint32(len("key3")))
+	binary.BigEndian.PutUint32(record[16:20], uint32(len("value3")))
+	copy(record[30:], "key3value3")
+	binary.BigEndian.PutUint32(record[:4], crc32.ChecksumIEEE(record[4:]))
+	v2.Write(record)
+	if err := os.WriteFile(filepath.Join(dir, "2000.data"), v2.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(dir); !errors.Is(err, ErrMigrationRequired) {
+		t.Fatalf("expected ErrMigrationRequired, got %v", err)
+	}
+
+	logger := Logger(log.New(io.Discard, "", 0))
+	if err := Migrate(dir, logger); err != nil {
+		t.Fatal(err)
+	}
+	// 重复迁移不会改动已经是新格式的文件
+	if err := Migrate(dir, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if value, err := db.Get("key1"); err != nil || string(value) != "value1" {
+		t.Errorf("Get key1 after migration: %s, %v", value, err)
+	}
+	if _, err := db.Get("key2"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected key2 to be deleted after migration, got %v", err)
+	}
+	if value, err := db.Get("key3"); err != nil || string(value) != "value3" {
+		t.Errorf("Get key3 after migration: %s, %v", value, err)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	header := encodeFileHeader(fileHeader{version: formatVersion + 1, kind: fileKindData})
+	if err := os.WriteFile(filepath.Join(dir, "1000.data"), header, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(dir); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+	if err := Migrate(dir); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected Migrate to refuse unknown version, got %v", err)
+	}
+}
+
+// reverseCodec 是测试用的自定义编码：去掉结尾的'x'之后把值反转
+type reverseCodec struct{}
+
+func (reverseCodec) ID() byte { return 100 }
+
+func reverse(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, c := range data {
+		out[len(data)-1-i] = c
+	}
+	return out
+}
+
+func (reverseCodec) Encode(value []byte) ([]byte, error) {
+	return reverse(bytes.TrimSuffix(value, []byte("x"))), nil
+}
+
+func (reverseCodec) Decode(data []byte) ([]byte, error) {
+	return append(reverse(data), 'x'), nil
+}
+
+func TestCodecs(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	large := bytes.Repeat([]byte("compressible "), 100)
+	sessions := []struct {
+		key  string
+		opts []ConfOption
+	}{
+		{"zlib", []ConfOption{CompressData(true)}},
+		{"flate", []ConfOption{Compression(FlateCodec)}},
+		{"none", nil},
+		{"custom", []ConfOption{Compression(reverseCodec{})}},
+	}
+
+	// 每次打开使用不同的压缩配置，之前写入的值必须仍然可读
+	for _, s := range sessions {
+		db, err := Open(dir, s.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value := large
+		if s.key == "custom" {
+			value = []byte("abcx")
+		}
+		if err := db.Put(s.key, value); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+
+	db, err := Open(dir, MaxDatafileSize(1024), MergeThreshold(1), MinCompressSize(16), CompressData(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("small", []byte("tiny")); err != nil {
+		t.Fatal(err)
+	}
+	e, _ := db.keydir.Get("small")
+	h, _, err := db.readRecord("small", e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.codec != CodecNone {
+		t.Errorf("expected value below MinCompressSize to be stored raw, got codec %d", h.codec)
+	}
+	e, _ = db.keydir.Get("flate")
+	h, _, err = db.readRecord("flate", e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.codec != CodecFlate {
+		t.Errorf("expected flate codec in record, got %d", h.codec)
+	}
+
+	check := func() {
+		t.Helper()
+		for _, s := range sessions {
+			want := large
+			if s.key == "custom" {
+				want = []byte("abcx")
+			}
+			value, err := db.Get(s.key)
+			if err != nil {
+				t.Errorf("Get %s failed: %v", s.key, err)
+			}
+			if !bytes.Equal(value, want) {
+				t.Errorf("Unexpected value for key %s: %q", s.key, value)
+			}
+		}
+	}
+	check()
+
+	// 合并之后编码保持不变
+	if err := db.Put("rotate", large); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Merge(context.Background(), MergeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+// prefixCodec 含有切片字段，接口值之间不能用==比较
+type prefixCodec struct {
+	prefix []byte
+}
+
+func (prefixCodec) ID() byte { return 101 }
+
+func (c prefixCodec) Encode(value []byte) ([]byte, error) {
+	return append(append([]byte{}, c.prefix...), value...), nil
+}
+
+func (c prefixCodec) Decode(data []byte) ([]byte, error) {
+	return append([]byte{}, data[len(c.prefix):]...), nil
+}
+
+func TestRegisterCodecUncomparable(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 同一类型的编码可以重复注册，每次打开都会注册一次
+	for i := 0; i < 2; i++ {
+		db, err := Open(dir, Compression(prefixCodec{prefix: []byte("p:")}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := fmt.Sprintf("key-%d", i)
+		if err := db.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "value" {
+			t.Errorf("Unexpected value for %s: %q", key, value)
+		}
+		db.Close()
+	}
+
+	if err := RegisterCodec(otherPrefixCodec{}); err == nil {
+		t.Error("expected registering a different codec type under the same ID to fail")
+	}
+}
+
+type otherPrefixCodec struct{ prefixCodec }
+
+func TestMergeConcurrentWrites(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, MaxDatafileSize(4096), MergeThreshold(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 写两遍，让较早的文件中全是无效数据
+	const numKeys = 2000
+	for round := 0; round < 2; round++ {
+		for i := 0; i < numKeys; i++ {
+			if err := db.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("old-%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	filesBefore := db.Stats().DataFiles
+
+	// 合并的同时覆盖一部分key并删除另一部分
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, err := db.Merge(context.Background(), MergeOptions{}); err != nil {
+			t.Errorf("merge failed: %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1500; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			if i < 1000 {
+				if err := db.Put(key, []byte(fmt.Sprintf("new-%d", i))); err != nil {
+					t.Errorf("Put failed: %v", err)
+				}
+			} else if err := db.Delete(key); err != nil {
+				t.Errorf("Delete failed: %v", err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	if db.Stats().DataFiles >= filesBefore {
+		t.Errorf("expected merge to reduce the number of data files, had %d, now %d", filesBefore, db.Stats().DataFiles)
+	}
+
+	check := func(db *Bitcask) {
+		t.Helper()
+		for i := 0; i < numKeys; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			value, err := db.Get(key)
+			switch {
+			case i < 1000:
+				if string(value) != fmt.Sprintf("new-%d", i) {
+					t.Errorf("Unexpected value for key %s. Got %s, %v", key, value, err)
+				}
+			case i < 1500:
+				if !errors.Is(err, ErrKeyNotFound) {
+					t.Errorf("expected key %s to be deleted, got %s, %v", key, value, err)
+				}
+			default:
+				if string(value) != fmt.Sprintf("old-%d", i) {
+					t.Errorf("Unexpected value for key %s. Got %s, %v", key, value, err)
+				}
+			}
+		}
+	}
+	check(db)
+	db.Close()
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestMergePolicy(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, MergeThreshold(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotate := func() {
+		db.mutex.Lock()
+		defer db.mutex.Unlock()
+		if err := db.rotateActiveFile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 第一个文件几乎都是有效数据，只有victim稍后会被删除
+	if err := db.Put("victim", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("filler-%d", i), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cleanFileID := db.activeFileID
+	rotate()
+
+	// 第二个文件几乎都是无效数据，还包含victim的墓碑
+	for i := 0; i < 20; i++ {
+		if err := db.Put("churn", []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("victim"); err != nil {
+		t.Fatal(err)
+	}
+	garbageFileID := db.activeFileID
+	rotate()
+	if err := db.Put("churn", []byte("final")); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := db.Stats()
+	var garbage FileStats
+	for _, fs := range stats.Files {
+		if fs.FileID == garbageFileID {
+			garbage = fs
+		}
+	}
+	if garbage.Ratio() < 0.9 || garbage.LiveBytes != 0 {
+		t.Fatalf("unexpected stats for garbage file: %+v", garbage)
+	}
+
+	if _, err := db.Merge(context.Background(), MergeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只有碎片率高的文件被合并
+	if _, err := os.Stat(db.getDataFilePath(cleanFileID)); err != nil {
+		t.Errorf("expected file with little garbage to be kept: %v", err)
+	}
+	if _, err := os.Stat(db.getDataFilePath(garbageFileID)); !os.IsNotExist(err) {
+		t.Errorf("expected fragmented file to be merged, got %v", err)
+	}
+	db.Close()
+
+	// 墓碑被保留下来，victim不会从没有合并的旧文件中恢复
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get("victim"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected victim to stay deleted, got %v", err)
+	}
+	if value, err := db.Get("churn"); err != nil || string(value) != "final" {
+		t.Errorf("Get churn: %s, %v", value, err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := db.Get(fmt.Sprintf("filler-%d", i)); err != nil {
+			t.Errorf("Get filler-%d failed: %v", i, err)
+		}
+	}
+}
+
+func TestMergeKeptTombstones(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, DisableAutoMerge())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rotate := func() {
+		t.Helper()
+		db.mutex.Lock()
+		defer db.mutex.Unlock()
+		if err := db.rotateActiveFile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 旧文件中大部分是有效值，新文件中只有删除其中一个key的墓碑
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotate()
+	if err := db.Delete("key-0"); err != nil {
+		t.Fatal(err)
+	}
+	rotate()
+
+	// 墓碑必须保留，只有墓碑的文件不值得合并
+	for i := 0; i < 3; i++ {
+		result, err := db.Merge(context.Background(), MergeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.FilesRemoved) != 0 || len(result.FilesCreated) != 0 {
+			t.Errorf("merge %d: expected no files to be merged, got %+v", i, result)
+		}
+	}
+
+	// 强制合并回收旧文件中被删除的值，再合并一次什么也不做
+	if _, err := db.Merge(context.Background(), MergeOptions{Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.Merge(context.Background(), MergeOptions{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.FilesRemoved) != 0 || len(result.FilesCreated) != 0 {
+		t.Errorf("expected second merge to be a no-op, got %+v", result)
+	}
+	if _, err := db.Get("key-0"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected key-0 to stay deleted, got %v", err)
+	}
+	db.Close()
+
+	// 重新打开之后墓碑仍然不会触发合并
+	db, err = Open(dir, DisableAutoMerge())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = db.Merge(context.Background(), MergeOptions{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.FilesRemoved) != 0 {
+		t.Errorf("expected merge after reopen to be a no-op, got %+v", result)
+	}
+	if _, err := db.Get("key-0"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected key-0 to stay deleted after reopen, got %v", err)
+	}
+}
+
+func TestMergeResult(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, MaxDatafileSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 50; i++ {
+			if err := db.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d-%d", round, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	before := db.Stats()
+
+	// 取消的合并不改变数据库
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.Merge(ctx, MergeOptions{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if after := db.Stats(); after.DataFiles != before.DataFiles {
+		t.Fatalf("cancelled merge changed data files: %d -> %d", before.DataFiles, after.DataFiles)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) == ".data" && !fileInStats(before, e.Name()) {
+			t.Errorf("cancelled merge left %s behind", e.Name())
+		}
+	}
+
+	var calls int
+	var last MergeProgress
+	result, err := db.Merge(context.Background(), MergeOptions{
+		Progress: func(p MergeProgress) {
+			calls++
+			last = p
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.FilesRemoved) == 0 || result.BytesReclaimed <= 0 {
+		t.Fatalf("unexpected merge result: %+v", result)
+	}
+	if calls != len(result.FilesRemoved) || last.BytesProcessed != last.BytesTotal {
+		t.Errorf("unexpected progress: %d calls, last %+v", calls, last)
+	}
+	if last.KeysRewritten != result.KeysRewritten {
+		t.Errorf("progress reported %d keys, result %d", last.KeysRewritten, result.KeysRewritten)
+	}
+	for _, fileID := range result.FilesRemoved {
+		if _, err := os.Stat(db.getDataFilePath(fileID)); !os.IsNotExist(err) {
+			t.Errorf("expected file %d to be removed, got %v", fileID, err)
+		}
+	}
+
+	var reclaimed int64
+	after := db.Stats()
+	for _, fs := range before.Files {
+		reclaimed += fs.Size
+	}
+	for _, fs := range after.Files {
+		reclaimed -= fs.Size
+	}
+	reclaimed += int64(before.DataFiles-after.DataFiles) * fileHeaderSize
+	if reclaimed != result.BytesReclaimed {
+		t.Errorf("expected %d bytes reclaimed, result says %d", reclaimed, result.BytesReclaimed)
+	}
+
+	for i := 0; i < 50; i++ {
+		value, err := db.Get(fmt.Sprintf("key-%d", i))
+		if err != nil || string(value) != fmt.Sprintf("value-2-%d", i) {
+			t.Errorf("Get key-%d: %s, %v", i, value, err)
+		}
+	}
+}
+
+func fileInStats(stats Stats, name string) bool {
+	for _, fs := range stats.Files {
+		if fmt.Sprintf("%d.data", fs.FileID) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMergeCrashRecovery(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	crashDir := filepath.Join(dir, "crash")
+	dbDir := filepath.Join(dir, "db")
+
+	db, err := Open(dbDir, MaxDatafileSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 最后一轮不覆盖key-40之后的key，它们的值留在有无效记录的旧文件中，合并时需要重写
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 50; i++ {
+			if round == 2 && i >= 40 {
+				continue
+			}
+			if err := db.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d-%d", round, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Delete(fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// 保留一份合并前的目录，用来模拟合并中途崩溃
+	if err := os.MkdirAll(crashDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := db.copyFile(filepath.Join(dbDir, e.Name()), filepath.Join(crashDir, e.Name())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err = Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.Merge(context.Background(), MergeOptions{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.FilesCreated) == 0 {
+		t.Fatalf("expected merge to create a file: %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(dbDir, mergeDirName)); !os.IsNotExist(err) {
+		t.Errorf("expected merge directory to be removed, got %v", err)
+	}
+
+	check := func(db *Bitcask) {
+		t.Helper()
+		for i := 0; i < 50; i++ {
+			value, err := db.Get(fmt.Sprintf("key-%d", i))
+			if i < 10 {
+				if !errors.Is(err, ErrKeyNotFound) {
+					t.Errorf("expected key-%d to be deleted, got %v", i, err)
+				}
+				continue
+			}
+			round := 2
+			if i >= 40 {
+				round = 1
+			}
+			if err != nil || string(value) != fmt.Sprintf("value-%d-%d", round, i) {
+				t.Errorf("Get key-%d: %s, %v", i, value, err)
+			}
+		}
+	}
+
+	// 模拟写入完成标记之后、移动文件之前崩溃：合并文件还在暂存目录中，旧文件都还在
+	crashed := &Bitcask{directory: crashDir}
+	if err := os.MkdirAll(crashed.getMergeDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, fileID := range result.FilesCreated {
+		for _, path := range []string{db.getDataFilePath(fileID), db.getHintFilePath(fileID)} {
+			if err := db.copyFile(path, filepath.Join(crashed.getMergeDir(), filepath.Base(path))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	db.Close()
+	if err := crashed.writeMergeMarker(result.FilesRemoved, result.FilesCreated); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(crashDir, Logger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileID := range result.FilesRemoved {
+		if _, err := os.Stat(db.getDataFilePath(fileID)); !os.IsNotExist(err) {
+			t.Errorf("expected merged file %d to be removed on open, got %v", fileID, err)
+		}
+	}
+	for _, fileID := range result.FilesCreated {
+		if _, err := os.Stat(db.getDataFilePath(fileID)); err != nil {
+			t.Errorf("expected merge output %d to be installed: %v", fileID, err)
+		}
+	}
+	if _, err := os.Stat(db.getMergeDir()); !os.IsNotExist(err) {
+		t.Errorf("expected merge directory to be removed, got %v", err)
+	}
+	check(db)
+	db.Close()
+
+	// 没有完成标记的暂存结果在打开时被丢弃
+	if err := os.MkdirAll(filepath.Join(dbDir, mergeDirName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	partial := filepath.Join(dbDir, mergeDirName, fmt.Sprintf("%d.data", result.FilesRemoved[0]))
+	if err := os.WriteFile(partial, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbDir, Logger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := os.Stat(filepath.Join(dbDir, mergeDirName)); !os.IsNotExist(err) {
+		t.Errorf("expected unfinished merge to be discarded, got %v", err)
+	}
+	check(db)
+}
+
+func TestMergeOutputRollover(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const maxFileSize = 1024
+	db, err := Open(dir, MaxDatafileSize(maxFileSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 100; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 覆盖一半的key，较早的文件中剩下的一半有效数据需要写入多个合并文件
+	for i := 0; i < 100; i += 2 {
+		if err := db.Put(fmt.Sprintf("key-%d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := db.Merge(context.Background(), MergeOptions{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.FilesCreated) < 2 {
+		t.Fatalf("expected merge output to span several files, got %v", result.FilesCreated)
+	}
+	for _, fileID := range result.FilesCreated {
+		fi, err := os.Stat(db.getDataFilePath(fileID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > maxFileSize {
+			t.Errorf("merged file %d is %d bytes, larger than MaxFileSize", fileID, fi.Size())
+		}
+		if _, err := os.Stat(db.getHintFilePath(fileID)); err != nil {
+			t.Errorf("expected hint file for merged file %d: %v", fileID, err)
+		}
+	}
+	db.Close()
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		got, err := db.Get(fmt.Sprintf("key-%d", i))
+		if err != nil || !bytes.Equal(got, value) {
+			t.Errorf("Get key-%d: %v", i, err)
+		}
+	}
+}
+
+func TestMergeScheduler(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	merged := make(chan MergeResult, 1)
+	var stopped bool
+	scheduler := func(ctx context.Context, db *Bitcask) {
+		result, err := db.Merge(ctx, MergeOptions{Force: true})
+		if err != nil {
+			t.Error(err)
+		}
+		merged <- result
+		<-ctx.Done()
+		// 模拟需要一点时间才能退出的调度器，Close必须等它返回
+		time.Sleep(10 * time.Millisecond)
+		stopped = true
+	}
+
+	// 准备需要合并的数据
+	db, err := Open(dir, MaxDatafileSize(1024), DisableAutoMerge())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 50; i++ {
+			if err := db.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d-%d", round, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	db.Close()
+
+	db, err = Open(dir, MergeScheduler(scheduler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case result := <-merged:
+		if len(result.FilesRemoved) == 0 {
+			t.Errorf("expected scheduler to merge files: %+v", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduler did not run")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !stopped {
+		t.Error("Close returned before the scheduler stopped")
+	}
+	if _, err := db.Merge(context.Background(), MergeOptions{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestDisableAutoMerge(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, disabled := range []bool{false, true} {
+		opts := []ConfOption{MaxDatafileSize(1024), MergeThreshold(1), MergeInterval(time.Millisecond)}
+		if disabled {
+			opts = append(opts, DisableAutoMerge())
+		}
+		db, err := Open(dir, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := db.Put("key", []byte(fmt.Sprintf("value-%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		files := db.Stats().DataFiles
+		time.Sleep(50 * time.Millisecond)
+
+		after := db.Stats().DataFiles
+		if disabled && after != files {
+			t.Errorf("expected no automatic merge, data files went from %d to %d", files, after)
+		}
+		if !disabled && after >= files {
+			t.Errorf("expected automatic merge, data files went from %d to %d", files, after)
+		}
+		// 后台合并在Close之后不再运行
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAutoMergeByRatio(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, MaxDatafileSize(1024), DisableAutoMerge())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Put("key", []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := db.Stats().DataFiles
+	db.Close()
+
+	// 只有几个数据文件，但封存的文件全是无效数据，默认配置下也要自动合并
+	db, err = Open(dir, MaxDatafileSize(1024), MergeInterval(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if files < 3 || files >= 10 {
+		t.Fatalf("expected a few data files, got %d", files)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stats().DataFiles >= files && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if after := db.Stats().DataFiles; after >= files {
+		t.Errorf("expected fragmented files to be merged automatically, data files went from %d to %d", files, after)
+	}
+	value, err := db.Get("key")
+	if err != nil || string(value) != "value-99" {
+		t.Errorf("Get after merge: %s, %v", value, err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(10000, 1000)
+
+	// 桶中的令牌可以立即使用
+	start := time.Now()
+	if err := l.wait(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected burst to pass immediately, took %v", elapsed)
+	}
+
+	// 超出的部分按速率等待
+	start = time.Now()
+	if err := l.wait(context.Background(), 2000); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected to wait about 200ms, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx, 100000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// 不限速时不等待
+	var unlimited *rateLimiter
+	if err := unlimited.wait(context.Background(), 1<<30); err != nil {
+		t.Fatal(err)
+	}
+
+	// 大块写入按桶的容量拆开，每块单独限速
+	var rec chunkRecorder
+	w := &limitedWriter{ctx: context.Background(), w: &rec, limiter: newRateLimiter(1<<20, 1000)}
+	n, err := w.Write(make([]byte, 4500))
+	if err != nil || n != 4500 {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	if len(rec.sizes) != 5 {
+		t.Errorf("expected 5 chunks, got %v", rec.sizes)
+	}
+	for _, size := range rec.sizes {
+		if size > 1000 {
+			t.Errorf("chunk of %d bytes exceeds burst", size)
+		}
+	}
+}
+
+// chunkRecorder 记录每次Write的长度
+type chunkRecorder struct {
+	sizes []int
+}
+
+func (r *chunkRecorder) Write(p []byte) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return len(p), nil
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db"), MaxDatafileSize(1024), BackgroundIORate(64*1024, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := db.Stats()
+	if stats.BackgroundIORate != 64*1024 || stats.BackgroundIOBudget != 64*1024 {
+		t.Errorf("unexpected I/O limit stats: rate %d, budget %d", stats.BackgroundIORate, stats.BackgroundIOBudget)
+	}
+
+	snapshotDir := filepath.Join(dir, "snapshot")
+	if err := db.Snapshot(snapshotDir); err != nil {
+		t.Fatal(err)
+	}
+	if budget := db.Stats().BackgroundIOBudget; budget >= 64*1024 {
+		t.Errorf("expected snapshot to use the I/O budget, %d left", budget)
+	}
+
+	// 快照之后的写入不影响快照
+	if err := db.Put("key-0", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := Open(snapshotDir, ReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	for i := 0; i < 100; i++ {
+		value, err := snap.Get(fmt.Sprintf("key-%d", i))
+		if err != nil || string(value) != fmt.Sprintf("value-%d", i) {
+			t.Errorf("Get key-%d from snapshot: %s, %v", i, value, err)
+		}
+	}
+}
+
+func TestMappingLifetime(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, MaxDatafileSize(1024), DisableAutoMerge())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 50; i++ {
+			if err := db.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d-%d", round, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	value, err := db.Get("key-49")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 被引用的映射在文件合并删除之后仍然可以读取
+	db.mutex.RLock()
+	pinned := db.pinFiles()
+	db.mutex.RUnlock()
+	result, err := db.Merge(context.Background(), MergeOptions{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.FilesRemoved) == 0 {
+		t.Fatal("expected merge to remove files")
+	}
+	for _, fileID := range result.FilesRemoved {
+		mf := pinned[fileID]
+		if _, err := decodeFileHeader(mf.data, fileKindData); err != nil {
+			t.Errorf("pinned mapping of merged file %d is not readable: %v", fileID, err)
+		}
+	}
+	unpinFiles(pinned)
+	for _, fileID := range result.FilesRemoved {
+		if pinned[fileID].data != nil {
+			t.Errorf("expected mapping of merged file %d to be released", fileID)
+		}
+	}
+
+	// Get返回的值不指向内存映射，关闭数据库之后仍然有效
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value-1-49" {
+		t.Errorf("value changed after Close: %q", value)
+	}
+}
+
+func TestView(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, Compression(FlateCodec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	plain := []byte("plain")
+	compressed := bytes.Repeat([]byte("compressible "), 100)
+	if err := db.Put("plain", plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("compressed", compressed); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string][]byte{"plain": plain, "compressed": compressed} {
+		err := db.View(key, func(value []byte) error {
+			if !bytes.Equal(value, want) {
+				t.Errorf("View %s: got %q", key, value)
+			}
+			// 回调中不持有锁，可以写入数据库
+			return db.Put(key+"-copy", value)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.Get(key + "-copy")
+		if err != nil || !bytes.Equal(value, want) {
+			t.Errorf("Get %s-copy: %v", key, err)
+		}
+	}
+
+	errStop := errors.New("stop")
+	if err := db.View("plain", func([]byte) error { return errStop }); err != errStop {
+		t.Errorf("expected callback error, got %v", err)
+	}
+	if err := db.View("missing", func([]byte) error { return nil }); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	// Get返回的是副本，修改它不影响数据库中的值
+	value, err := db.Get("plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value[0] = 'X'
+	db.View("plain", func(value []byte) error {
+		if !bytes.Equal(value, plain) {
+			t.Errorf("modifying the result of Get changed the stored value: %q", value)
+		}
+		return nil
+	})
+}
+
+func TestActiveFileMapping(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, MaxDatafileSize(64*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// 活动文件写满之前不会重新映射
+	mf := db.mmapedFiles[db.activeFileID]
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if err := db.Put(key, []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.Get(key)
+		if err != nil || string(value) != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("Get %s right after Put: %s, %v", key, value, err)
+		}
+	}
+	if db.mmapedFiles[db.activeFileID] != mf {
+		t.Error("expected the active file to keep its mapping across puts")
+	}
+
+	// 超过MaxFileSize的记录仍然可以写入和读取
+	large := bytes.Repeat([]byte("x"), 200*1024)
+	if err := db.Put("large", large); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("after-large", []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("large"); err != nil || !bytes.Equal(value, large) {
+		t.Errorf("Get large: %v", err)
+	}
+	if value, err := db.Get("after-large"); err != nil || string(value) != "small" {
+		t.Errorf("Get after-large: %s, %v", value, err)
+	}
+}
+
+func TestSyncPolicy(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	diskSize := func(db *Bitcask) int64 {
+		t.Helper()
+		fi, err := os.Stat(db.getDataFilePath(db.activeFileID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	// 非正的间隔或字节阈值在Open时报错，而不是在后台goroutine中panic
+	for _, policy := range []SyncPolicy{SyncEvery(0), SyncEvery(-time.Second), SyncEveryBytes(0), SyncEveryBytes(-1)} {
+		if db, err := Open(filepath.Join(dir, "invalid"), WithSyncPolicy(policy)); err == nil {
+			db.Close()
+			t.Errorf("expected Open to reject %+v", policy)
+		}
+	}
+
+	value := bytes.Repeat([]byte("v"), 100)
+	recordLen := int64(headerSize + len("key-0") + len(value))
+
+	tests := []struct {
+		name   string
+		policy SyncPolicy
+		// 写入一条记录后立即检查的文件大小，以及在这之后等待直到满足的文件大小
+		immediate int64
+		eventual  int64
+	}{
+		{"always", SyncAlways(), fileHeaderSize + recordLen, fileHeaderSize + recordLen},
+		{"bytes", SyncEveryBytes(2 * recordLen), fileHeaderSize, fileHeaderSize},
+		{"interval", SyncEvery(5 * time.Millisecond), fileHeaderSize, fileHeaderSize + recordLen},
+		{"never", SyncNever(), fileHeaderSize, fileHeaderSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := Open(filepath.Join(dir, tt.name), WithSyncPolicy(tt.policy), WriteBufferSize(DefaultWriteBufferSize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if err := db.Put("key-0", value); err != nil {
+				t.Fatal(err)
+			}
+			// 还没有写入文件的记录也能读到
+			if got, err := db.Get("key-0"); err != nil || !bytes.Equal(got, value) {
+				t.Fatalf("Get buffered key: %v", err)
+			}
+			if err := db.View("key-0", func(got []byte) error {
+				if !bytes.Equal(got, value) {
+					t.Errorf("View buffered key: %q", got)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			db.mutex.Lock()
+			size := diskSize(db)
+			db.mutex.Unlock()
+			if size != tt.immediate {
+				t.Errorf("expected %d bytes on disk right after Put, got %d", tt.immediate, size)
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				db.mutex.Lock()
+				size = diskSize(db)
+				db.mutex.Unlock()
+				if size == tt.eventual || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if size != tt.eventual {
+				t.Errorf("expected %d bytes on disk eventually, got %d", tt.eventual, size)
+			}
+
+			// 写满字节阈值时落盘
+			if err := db.Put("key-1", value); err != nil {
+				t.Fatal(err)
+			}
+			if tt.name == "bytes" {
+				if size := diskSize(db); size != fileHeaderSize+2*recordLen {
+					t.Errorf("expected records to be synced after %d bytes, got %d bytes on disk", 2*recordLen, size)
+				}
+			}
+
+			// Sync写入并落盘所有记录
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			if size := diskSize(db); size != fileHeaderSize+2*recordLen {
+				t.Errorf("expected all records on disk after Sync, got %d bytes", size)
+			}
+		})
+	}
+
+	// 默认不缓冲，每条记录直接写入文件
+	db, err := Open(filepath.Join(dir, "default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("key-0", value); err != nil {
+		t.Fatal(err)
+	}
+	db.mutex.Lock()
+	size := diskSize(db)
+	db.mutex.Unlock()
+	if size != fileHeaderSize+recordLen {
+		t.Errorf("expected the default config to write records through, got %d bytes on disk", size)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.PutWithTTL("short", []byte("value"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("long", []byte("value"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("plain", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl, err := db.TTL("long"); err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("TTL long: %v, %v", ttl, err)
+	}
+	if ttl, err := db.TTL("plain"); err != nil || ttl != 0 {
+		t.Errorf("expected no expiry for plain, got %v, %v", ttl, err)
+	}
+	if _, err := db.TTL("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound for missing key, got %v", err)
+	}
+
+	// Expire修改过期时间，值保持不变
+	if err := db.Expire("plain", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Expire("long", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Expire("missing", time.Hour); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound when expiring missing key, got %v", err)
+	}
+	if ttl, err := db.TTL("plain"); err != nil || ttl <= 0 {
+		t.Errorf("TTL plain after Expire: %v, %v", ttl, err)
+	}
+	if value, err := db.Get("plain"); err != nil || string(value) != "value" {
+		t.Errorf("Get plain after Expire: %s, %v", value, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := db.Get("short"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected expired key to be missing, got %v", err)
+	}
+	if err := db.View("short", func([]byte) error { return nil }); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected View of expired key to fail, got %v", err)
+	}
+	if _, err := db.TTL("short"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected TTL of expired key to fail, got %v", err)
+	}
+	if err := db.Expire("short", time.Hour); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected Expire of expired key to fail, got %v", err)
+	}
+	it := db.Iterator()
+	for it.Next() {
+		if it.Key() == "short" {
+			t.Error("expected iterator to skip expired key")
+		}
+	}
+	it.Close()
+	db.Close()
+
+	// 过期时间在重新打开之后仍然有效
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get("short"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected expired key to be missing after reopen, got %v", err)
+	}
+	if ttl, err := db.TTL("long"); err != nil || ttl != 0 {
+		t.Errorf("expected no expiry for long after reopen, got %v, %v", ttl, err)
+	}
+	if ttl, err := db.TTL("plain"); err != nil || ttl <= 0 {
+		t.Errorf("expected plain to keep its expiry after reopen, got %v, %v", ttl, err)
+	}
+}
+
+func TestMergeDropsExpired(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, MaxDatafileSize(1024), DisableAutoMerge())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("keep-%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutWithTTL(fmt.Sprintf("temp-%d", i), []byte("value"), 50*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 写满活动文件，让上面的记录都在已封存的文件中
+	for i := 0; i < 20; i++ {
+		if err := db.Put("filler", bytes.Repeat([]byte("f"), 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// 过期的值计为无效字节，按碎片率就会被选中合并
+	result, err := db.Merge(context.Background(), MergeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.FilesRemoved) == 0 {
+		t.Fatalf("expected expired values to make files eligible for merge: %+v", result)
+	}
+	if result.KeysRewritten != 20 {
+		t.Errorf("expected only the 20 live keys to be rewritten, got %d", result.KeysRewritten)
+	}
+
+	for _, fileID := range result.FilesCreated {
+		err := db.scanDataFile(fileID, func(key string, hr hintRecord) error {
+			if strings.HasPrefix(key, "temp-") && hr.recordType == recordTypeValue {
+				t.Errorf("expected expired %s to be dropped from merged file %d", key, fileID)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := db.Stats()
+	if stats.Keys != 21 {
+		t.Errorf("expected expired keys to be removed from keydir, got %d keys", stats.Keys)
+	}
+	for i := 0; i < 20; i++ {
+		if value, err := db.Get(fmt.Sprintf("keep-%d", i)); err != nil || string(value) != "value" {
+			t.Errorf("Get keep-%d after merge: %s, %v", i, value, err)
+		}
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 事务内可以读到自己的写入，提交后一起生效
+	err = db.Update(func(tx *Tx) error {
+		a, err := tx.Get("a")
+		if err != nil {
+			return err
+		}
+		if err := tx.Put("b", a); err != nil {
+			return err
+		}
+		if err := tx.Delete("a"); err != nil {
+			return err
+		}
+		if value, err := tx.Get("b"); err != nil || string(value) != "1" {
+			t.Errorf("Get b inside transaction: %s, %v", value, err)
+		}
+		if _, err := tx.Get("a"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("expected a to be deleted inside transaction, got %v", err)
+		}
+		if value, err := db.Get("b"); err != nil || string(value) != "2" {
+			t.Errorf("expected uncommitted write to be invisible, got %s, %v", value, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("b"); err != nil || string(value) != "1" {
+		t.Errorf("Get b after commit: %s, %v", value, err)
+	}
+	if _, err := db.Get("a"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected a to be deleted after commit, got %v", err)
+	}
+
+	// 函数返回错误时丢弃写入
+	errAbort := errors.New("abort")
+	if err := db.Update(func(tx *Tx) error {
+		tx.Put("c", []byte("3"))
+		return errAbort
+	}); !errors.Is(err, errAbort) {
+		t.Errorf("expected abort error, got %v", err)
+	}
+	if _, err := db.Get("c"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected aborted write to be discarded, got %v", err)
+	}
+
+	// 读过的key在提交前被修改或删除时冲突
+	for name, change := range map[string]func() error{
+		"put":    func() error { return db.Put("b", []byte("other")) },
+		"delete": func() error { return db.Delete("b") },
+		"create": func() error { return db.Put("missing", []byte("new")) },
+	} {
+		err := db.Update(func(tx *Tx) error {
+			tx.Get("b")
+			tx.Get("missing")
+			if err := change(); err != nil {
+				return err
+			}
+			return tx.Put("d", []byte("4"))
+		})
+		if !errors.Is(err, ErrConflict) {
+			t.Errorf("%s: expected ErrConflict, got %v", name, err)
+		}
+		if _, err := db.Get("d"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("%s: expected conflicting transaction to write nothing, got %v", name, err)
+		}
+		db.Delete("missing")
+	}
+
+	err = db.ViewTx(func(tx *Tx) error {
+		if err := tx.Put("e", []byte("5")); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("expected ErrReadOnly from Put in ViewTx, got %v", err)
+		}
+		_, err := tx.Get("b")
+		return err
+	})
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// 并发的读-改-写事务不会丢失更新
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("counter", []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := db.Update(func(tx *Tx) error {
+					value, err := tx.Get("counter")
+					if err != nil {
+						return err
+					}
+					var n int
+					fmt.Sscan(string(value), &n)
+					return tx.Put("counter", []byte(fmt.Sprint(n+1)))
+				})
+				if !errors.Is(err, ErrConflict) {
+					if err != nil {
+						t.Error(err)
+					}
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if value, err := db.Get("counter"); err != nil || string(value) != "10" {
+		t.Errorf("expected counter to be 10, got %s, %v", value, err)
+	}
+}
+
+func TestReadSnapshot(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, MaxDatafileSize(1024), DisableAutoMerge())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("old-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutWithTTL("ttl", []byte("value"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := db.NewReadSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 快照之后的覆盖、删除、过期和合并都不影响快照
+	for i := 0; i < 20; i++ {
+		if i%2 == 0 {
+			err = db.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("new-%d", i)))
+		} else {
+			err = db.Delete(fmt.Sprintf("key-%d", i))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("added", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	result, err := db.Merge(context.Background(), MergeOptions{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.FilesRemoved) == 0 {
+		t.Fatalf("expected merge to remove files: %+v", result)
+	}
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if value, err := snap.Get(key); err != nil || string(value) != fmt.Sprintf("old-%d", i) {
+			t.Errorf("snapshot Get %s: %s, %v", key, value, err)
+		}
+	}
+	if value, err := snap.Get("ttl"); err != nil || string(value) != "value" {
+		t.Errorf("expected key expiring after the snapshot to stay visible, got %s, %v", value, err)
+	}
+	if _, err := snap.Get("added"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected key added after the snapshot to be missing, got %v", err)
+	}
+	if value, err := db.Get("key-0"); err != nil || string(value) != "new-0" {
+		t.Errorf("db Get key-0: %s, %v", value, err)
+	}
+
+	it := snap.Iterator()
+	n := 0
+	for it.Next() {
+		if _, err := it.Value(); err != nil {
+			t.Errorf("snapshot iterator value for %s: %v", it.Key(), err)
+		}
+		n++
+	}
+	if n != 21 {
+		t.Errorf("expected snapshot iterator to see 21 keys, got %d", n)
+	}
+	it.Close()
+
+	snap.Release()
+	snap.Release()
+	if _, err := snap.Get("key-0"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed after Release, got %v", err)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	for name, newIndex := range map[string]func() Index{"btree": NewBTreeIndex, "hash": NewHashIndex} {
+		t.Run(name, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			idx := newIndex()
+			model := make(map[string]Entry)
+
+			check := func(idx Index, model map[string]Entry) {
+				t.Helper()
+				if idx.Len() != len(model) {
+					t.Fatalf("expected %d keys, got %d", len(model), idx.Len())
+				}
+				keys := make([]string, 0, len(model))
+				for k := range model {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				var got []string
+				idx.Ascend("", func(k string, e Entry) bool {
+					if e != model[k] {
+						t.Fatalf("entry for %s: %+v, expected %+v", k, e, model[k])
+					}
+					got = append(got, k)
+					return true
+				})
+				if len(got) != len(keys) || (len(keys) > 0 && !reflect.DeepEqual(got, keys)) {
+					t.Fatalf("expected keys in order %v, got %v", keys, got)
+				}
+				if bt, ok := idx.(*btreeIndex); ok && bt.root != nil {
+					checkBTreeNode(t, bt.root, true)
+				}
+			}
+
+			// 随机的插入、覆盖和删除，和map的结果比较；中途的副本不受之后修改的影响
+			var clones []Index
+			var models []map[string]Entry
+			for i := 0; i < 20000; i++ {
+				key := fmt.Sprintf("key-%04d", rnd.Intn(2000))
+				if rnd.Intn(3) == 0 {
+					idx.Delete(key)
+					delete(model, key)
+				} else {
+					e := Entry{timestamp: int64(i + 1), fileID: int64(rnd.Intn(10))}
+					idx.Set(key, e)
+					model[key] = e
+				}
+				if e, ok := idx.Get(key); ok != (model[key] != Entry{}) || e != model[key] {
+					t.Fatalf("get %s after op %d: %+v, %v", key, i, e, ok)
+				}
+				if i%5000 == 0 {
+					clones = append(clones, idx.Clone())
+					copied := make(map[string]Entry, len(model))
+					for k, e := range model {
+						copied[k] = e
+					}
+					models = append(models, copied)
+				}
+			}
+			check(idx, model)
+			for i := range clones {
+				check(clones[i], models[i])
+			}
+
+			// Ascend从from开始，fn返回false时停止
+			var got []string
+			idx.Ascend("key-1000", func(k string, e Entry) bool {
+				got = append(got, k)
+				return len(got) < 3
+			})
+			if len(got) != 3 || got[0] < "key-1000" || !sort.StringsAreSorted(got) {
+				t.Errorf("unexpected ascend result from key-1000: %v", got)
+			}
+
+			for k := range model {
+				idx.Delete(k)
+			}
+			check(idx, map[string]Entry{})
+		})
+	}
+}
+
+// checkBTreeNode 检查节点的key数量在范围内并且有序，所有叶子节点深度相同，返回子树的深度
+func checkBTreeNode(t *testing.T, n *btreeNode, root bool) int {
+	t.Helper()
+	if len(n.items) > btreeMaxItems || (!root && len(n.items) < btreeDegree-1) {
+		t.Fatalf("node has %d items", len(n.items))
+	}
+	if !sort.SliceIsSorted(n.items, func(i, j int) bool { return n.items[i].key < n.items[j].key }) {
+		t.Fatal("node items are not sorted")
+	}
+	if n.leaf() {
+		return 1
+	}
+	if len(n.children) != len(n.items)+1 {
+		t.Fatalf("node has %d items and %d children", len(n.items), len(n.children))
+	}
+	depth := checkBTreeNode(t, n.children[0], false)
+	for _, c := range n.children[1:] {
+		if checkBTreeNode(t, c, false) != depth {
+			t.Fatal("leaves are at different depths")
+		}
+	}
+	return depth + 1
+}
+
+// countingIndex 是测试用的自定义索引，包装内置索引并统计写入次数
+type countingIndex struct {
+	Index
+	sets int
+}
+
+func (c *countingIndex) Set(key string, e Entry) {
+	c.sets++
+	c.Index.Set(key, e)
+}
+
+func TestScan(t *testing.T) {
+	indexes := map[string]func() Index{
+		"btree":  NewBTreeIndex,
+		"hash":   NewHashIndex,
+		"custom": func() Index { return &countingIndex{Index: NewBTreeIndex()} },
+	}
+	for name, newIndex := range indexes {
+		t.Run(name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "bitcask-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := Open(dir, WithIndex(newIndex))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if custom, ok := db.keydir.(*countingIndex); ok {
+				defer func() {
+					if custom.sets == 0 {
+						t.Error("expected writes to go through the custom index")
+					}
+				}()
+			}
+
+			for _, key := range []string{"b/2", "a/1", "c/1", "b/1", "a/2", "b/3"} {
+				if err := db.Put(key, []byte("v-"+key)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			collect := func(scan func(fn func(key string, value []byte) error) error) []string {
+				t.Helper()
+				var keys []string
+				err := scan(func(key string, value []byte) error {
+					if string(value) != "v-"+key {
+						t.Errorf("value for %s: %s", key, value)
+					}
+					keys = append(keys, key)
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return keys
+			}
+
+			if got := collect(func(fn func(string, []byte) error) error { return db.Scan("a/2", "c/1", fn) }); !reflect.DeepEqual(got, []string{"a/2", "b/1", "b/2", "b/3"}) {
+				t.Errorf("Scan a/2..c/1: %v", got)
+			}
+			if got := collect(func(fn func(string, []byte) error) error { return db.Scan("", "", fn) }); len(got) != 6 || !sort.StringsAreSorted(got) {
+				t.Errorf("Scan all: %v", got)
+			}
+			if got := collect(func(fn func(string, []byte) error) error { return db.ScanPrefix("b/", fn) }); !reflect.DeepEqual(got, []string{"b/1", "b/2", "b/3"}) {
+				t.Errorf("ScanPrefix b/: %v", got)
+			}
+
+			// 回调可以写入数据库，返回的错误会停止扫描
+			errStop := errors.New("stop")
+			n := 0
+			err = db.Scan("", "", func(key string, value []byte) error {
+				if err := db.Put("z/"+key, value); err != nil {
+					return err
+				}
+				if n++; n == 2 {
+					return errStop
+				}
+				return nil
+			})
+			if !errors.Is(err, errStop) || n != 2 {
+				t.Errorf("expected scan to stop after 2 keys with errStop, got %d, %v", n, err)
+			}
+
+			it := db.Iterator()
+			defer it.Close()
+			if !it.Seek("b/") || it.Key() != "b/1" {
+				t.Errorf("Seek b/: %v", it.Valid())
+			}
+			if !it.Prev() || it.Key() != "a/2" {
+				t.Error("expected Prev to move to a/2")
+			}
+			var reversed []string
+			for ok := it.SeekToLast(); ok; ok = it.Prev() {
+				reversed = append(reversed, it.Key())
+			}
+			if len(reversed) != 8 || reversed[0] != "z/a/2" || reversed[7] != "a/1" {
+				t.Errorf("reverse iteration: %v", reversed)
+			}
+			if !it.SeekToFirst() || it.Key() != "a/1" {
+				t.Error("expected SeekToFirst to move to a/1")
+			}
+			if it.Seek("zz") {
+				t.Error("expected Seek past the last key to be invalid")
+			}
+		})
+	}
+}
+
+func TestIterator(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, MaxDatafileSize(1024), DisableAutoMerge())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var all []string
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("%c/%02d", 'a'+i%3, i)
+		all = append(all, key)
+		if err := db.Put(key, []byte("v-"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(all)
+
+	keys := func(opts IteratorOptions) []string {
+		t.Helper()
+		it := db.NewIterator(opts)
+		defer it.Close()
+		var keys []string
+		for it.Next() {
+			value, err := it.Value()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !opts.KeysOnly && string(value) != "v-"+it.Key() {
+				t.Errorf("value for %s: %s", it.Key(), value)
+			}
+			if opts.KeysOnly && value != nil {
+				t.Errorf("expected no value in KeysOnly mode, got %s", value)
+			}
+			keys = append(keys, it.Key())
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	// 第一个key也会被访问，每个key只访问一次
+	if got := keys(IteratorOptions{}); !reflect.DeepEqual(got, all) {
+		t.Errorf("expected all keys in order, got %v", got)
+	}
+	if got := keys(IteratorOptions{KeysOnly: true}); !reflect.DeepEqual(got, all) {
+		t.Errorf("expected all keys in KeysOnly mode, got %v", got)
+	}
+	if got := keys(IteratorOptions{Lower: "a/15", Upper: "b/04"}); !reflect.DeepEqual(got, []string{"a/15", "a/18", "a/21", "a/24", "a/27", "b/01"}) {
+		t.Errorf("Lower a/15 Upper b/04: %v", got)
+	}
+	if got := keys(IteratorOptions{Prefix: "c/", Upper: "c/10"}); !reflect.DeepEqual(got, []string{"c/02", "c/05", "c/08"}) {
+		t.Errorf("Prefix c/ Upper c/10: %v", got)
+	}
+	if got := keys(IteratorOptions{Prefix: "b/", Lower: "c/"}); len(got) != 0 {
+		t.Errorf("expected disjoint Prefix and Lower to visit nothing, got %v", got)
+	}
+
+	// 迭代期间删除、覆盖和合并都不影响迭代器
+	it := db.Iterator()
+	for i, key := range all {
+		if i%2 == 0 {
+			err = db.Delete(key)
+		} else {
+			err = db.Put(key, []byte("new"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err := db.Merge(context.Background(), MergeOptions{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.FilesRemoved) == 0 {
+		t.Fatalf("expected merge to remove files: %+v", result)
+	}
+	n := 0
+	for it.Next() {
+		value, err := it.Value()
+		if err != nil || string(value) != "v-"+it.Key() {
+			t.Errorf("value for %s during merge: %s, %v", it.Key(), value, err)
+		}
+		n++
+	}
+	if n != len(all) {
+		t.Errorf("expected %d keys, got %d", len(all), n)
+	}
+
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if it.SeekToFirst() || it.Next() {
+		t.Error("expected closed iterator to be invalid")
+	}
+	if _, err := it.Value(); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed from Value after Close, got %v", err)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "db", "*.data"))
+
+	wb := db.NewWriteBatch()
+	wb.Put("key", []byte("value"))
+	ops := map[string]func() error{
+		"Put":        func() error { return db.Put("key", []byte("new")) },
+		"PutWithTTL": func() error { return db.PutWithTTL("key", []byte("new"), time.Hour) },
+		"Expire":     func() error { return db.Expire("key", time.Hour) },
+		"Delete":     func() error { return db.Delete("key") },
+		"Commit":     wb.Commit,
+		"Update":     func() error { return db.Update(func(tx *Tx) error { return tx.Put("key", []byte("new")) }) },
+		"Get":        func() error { _, err := db.Get("key"); return err },
+		"View":       func() error { return db.View("key", func([]byte) error { return nil }) },
+		"BatchGet":   func() error { _, err := db.BatchGet([]string{"key"}); return err },
+		"TTL":        func() error { _, err := db.TTL("key"); return err },
+		"Tx.Get":     func() error { return db.ViewTx(func(tx *Tx) error { _, err := tx.Get("key"); return err }) },
+		"Sync":       db.Sync,
+		"Snapshot":   func() error { return db.Snapshot(filepath.Join(dir, "snapshot")) },
+		"Scan":       func() error { return db.Scan("", "", func(string, []byte) error { return nil }) },
+		"Iterator":   func() error { return db.Iterator().Err() },
+		"KeysOnly":   func() error { return db.NewIterator(IteratorOptions{KeysOnly: true}).Err() },
+		"Merge":      func() error { _, err := db.Merge(context.Background(), MergeOptions{Force: true}); return err },
+		"Close":      db.Close,
+	}
+	for name, op := range ops {
+		if err := op(); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s after Close: expected ErrClosed, got %v", name, err)
+		}
+	}
+
+	// 关闭之后的写入不能在已经释放锁的目录中创建新文件
+	after, _ := filepath.Glob(filepath.Join(dir, "db", "*.data"))
+	if len(after) != len(files) {
+		t.Errorf("expected %d data files after writes on a closed database, got %d", len(files), len(after))
+	}
+}
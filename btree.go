@@ -0,0 +1,325 @@
+package bitcask
+
+import "sort"
+
+// btreeDegree 是B树的最小度数，除根节点外每个节点有degree-1到2*degree-1个key
+const btreeDegree = 32
+
+const btreeMaxItems = 2*btreeDegree - 1
+
+type btreeItem struct {
+	key string
+	e   Entry
+}
+
+type btreeNode struct {
+	items    []btreeItem
+	children []*btreeNode
+	owner    *btreeOwner
+}
+
+// btreeOwner 标记节点属于哪棵树。Clone之后两棵树共享原有节点，各自修改之前先复制不属于自己的节点
+type btreeOwner struct {
+	_ byte // 非零大小，保证每次分配的地址不同
+}
+
+// btreeIndex 是按key排序的写时复制B树
+type btreeIndex struct {
+	root  *btreeNode
+	count int
+	owner *btreeOwner
+}
+
+func newBTreeIndex() *btreeIndex {
+	return &btreeIndex{owner: &btreeOwner{}}
+}
+
+func (n *btreeNode) leaf() bool {
+	return len(n.children) == 0
+}
+
+// find 返回第一个不小于key的位置，以及该位置的key是否等于key
+func (n *btreeNode) find(key string) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool { return n.items[i].key >= key })
+	return i, i < len(n.items) && n.items[i].key == key
+}
+
+func (n *btreeNode) copy(owner *btreeOwner) *btreeNode {
+	c := &btreeNode{owner: owner}
+	c.items = append(make([]btreeItem, 0, btreeMaxItems), n.items...)
+	if !n.leaf() {
+		c.children = append(make([]*btreeNode, 0, btreeMaxItems+1), n.children...)
+	}
+	return c
+}
+
+func (n *btreeNode) insertItem(i int, item btreeItem) {
+	n.items = append(n.items, btreeItem{})
+	copy(n.items[i+1:], n.items[i:])
+	n.items[i] = item
+}
+
+func (n *btreeNode) removeItem(i int) btreeItem {
+	item := n.items[i]
+	copy(n.items[i:], n.items[i+1:])
+	n.items[len(n.items)-1] = btreeItem{}
+	n.items = n.items[:len(n.items)-1]
+	return item
+}
+
+func (n *btreeNode) insertChild(i int, child *btreeNode) {
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = child
+}
+
+func (n *btreeNode) removeChild(i int) *btreeNode {
+	child := n.children[i]
+	copy(n.children[i:], n.children[i+1:])
+	n.children[len(n.children)-1] = nil
+	n.children = n.children[:len(n.children)-1]
+	return child
+}
+
+func (n *btreeNode) min() btreeItem {
+	for !n.leaf() {
+		n = n.children[0]
+	}
+	return n.items[0]
+}
+
+func (n *btreeNode) max() btreeItem {
+	for !n.leaf() {
+		n = n.children[len(n.children)-1]
+	}
+	return n.items[len(n.items)-1]
+}
+
+// ascend 按顺序对不小于from的key调用fn，fn返回false时停止
+func (n *btreeNode) ascend(from string, fn func(key string, e Entry) bool) bool {
+	i, _ := n.find(from)
+	for ; i < len(n.items); i++ {
+		if !n.leaf() && !n.children[i].ascend(from, fn) {
+			return false
+		}
+		if !fn(n.items[i].key, n.items[i].e) {
+			return false
+		}
+	}
+	if !n.leaf() {
+		return n.children[len(n.items)].ascend(from, fn)
+	}
+	return true
+}
+
+func (t *btreeIndex) Get(key string) (Entry, bool) {
+	n := t.root
+	for n != nil {
+		i, found := n.find(key)
+		if found {
+			return n.items[i].e, true
+		}
+		if n.leaf() {
+			break
+		}
+		n = n.children[i]
+	}
+	return Entry{}, false
+}
+
+func (t *btreeIndex) Len() int {
+	return t.count
+}
+
+// Clone 返回共享所有节点的副本，之后两棵树的修改互不影响
+func (t *btreeIndex) Clone() Index {
+	t.owner = &btreeOwner{}
+	return &btreeIndex{root: t.root, count: t.count, owner: &btreeOwner{}}
+}
+
+func (t *btreeIndex) Ascend(from string, fn func(key string, e Entry) bool) {
+	if t.root != nil {
+		t.root.ascend(from, fn)
+	}
+}
+
+func (t *btreeIndex) mutableRoot() *btreeNode {
+	if t.root.owner != t.owner {
+		t.root = t.root.copy(t.owner)
+	}
+	return t.root
+}
+
+// mutableChild 返回n的第i个子节点，子节点不属于这棵树时先复制。n必须已经属于这棵树
+func (t *btreeIndex) mutableChild(n *btreeNode, i int) *btreeNode {
+	c := n.children[i]
+	if c.owner != t.owner {
+		c = c.copy(t.owner)
+		n.children[i] = c
+	}
+	return c
+}
+
+func (t *btreeIndex) Set(key string, e Entry) {
+	item := btreeItem{key: key, e: e}
+	if t.root == nil {
+		t.root = &btreeNode{owner: t.owner, items: append(make([]btreeItem, 0, btreeMaxItems), item)}
+		t.count++
+		return
+	}
+
+	root := t.mutableRoot()
+	if len(root.items) == btreeMaxItems {
+		t.root = &btreeNode{owner: t.owner, children: append(make([]*btreeNode, 0, btreeMaxItems+1), root)}
+		t.splitChild(t.root, 0)
+	}
+	if t.insert(t.root, item) {
+		t.count++
+	}
+}
+
+// insert 把item插入未满的节点n的子树，key已存在时替换，返回是否新增了key
+func (t *btreeIndex) insert(n *btreeNode, item btreeItem) bool {
+	i, found := n.find(item.key)
+	if found {
+		n.items[i] = item
+		return false
+	}
+	if n.leaf() {
+		n.insertItem(i, item)
+		return true
+	}
+
+	// 下降之前分裂已满的子节点，保证插入时不需要回溯
+	if len(n.children[i].items) == btreeMaxItems {
+		t.splitChild(n, i)
+		switch {
+		case item.key == n.items[i].key:
+			n.items[i] = item
+			return false
+		case item.key > n.items[i].key:
+			i++
+		}
+	}
+	return t.insert(t.mutableChild(n, i), item)
+}
+
+// splitChild 把n已满的第i个子节点从中间分成两个，中间的key上移到n
+func (t *btreeIndex) splitChild(n *btreeNode, i int) {
+	child := t.mutableChild(n, i)
+	mid := btreeDegree - 1
+	median := child.items[mid]
+
+	right := &btreeNode{owner: t.owner}
+	right.items = append(make([]btreeItem, 0, btreeMaxItems), child.items[mid+1:]...)
+	for j := mid; j < len(child.items); j++ {
+		child.items[j] = btreeItem{}
+	}
+	child.items = child.items[:mid]
+	if !child.leaf() {
+		right.children = append(make([]*btreeNode, 0, btreeMaxItems+1), child.children[mid+1:]...)
+		for j := mid + 1; j < len(child.children); j++ {
+			child.children[j] = nil
+		}
+		child.children = child.children[:mid+1]
+	}
+
+	n.insertItem(i, median)
+	n.insertChild(i+1, right)
+}
+
+func (t *btreeIndex) Delete(key string) {
+	if t.root == nil {
+		return
+	}
+	root := t.mutableRoot()
+	if t.remove(root, key) {
+		t.count--
+	}
+	// 根节点的两个子节点合并之后根节点可能为空
+	if len(root.items) == 0 {
+		if root.leaf() {
+			t.root = nil
+		} else {
+			t.root = root.children[0]
+		}
+	}
+}
+
+// remove 从n的子树中删除key，返回key是否存在。调用方保证n属于这棵树，
+// 并且n不是根节点时至少有degree个key，因此删除之后不会少于degree-1个
+func (t *btreeIndex) remove(n *btreeNode, key string) bool {
+	i, found := n.find(key)
+	if n.leaf() {
+		if !found {
+			return false
+		}
+		n.removeItem(i)
+		return true
+	}
+
+	if found {
+		// 用前驱或后继替换被删除的key，子节点key不够时合并两个子节点
+		if len(n.children[i].items) >= btreeDegree {
+			left := t.mutableChild(n, i)
+			pred := left.max()
+			t.remove(left, pred.key)
+			n.items[i] = pred
+			return true
+		}
+		if len(n.children[i+1].items) >= btreeDegree {
+			right := t.mutableChild(n, i+1)
+			succ := right.min()
+			t.remove(right, succ.key)
+			n.items[i] = succ
+			return true
+		}
+		t.mergeChildren(n, i)
+		return t.remove(n.children[i], key)
+	}
+
+	if len(n.children[i].items) < btreeDegree {
+		i = t.growChild(n, i)
+	}
+	return t.remove(t.mutableChild(n, i), key)
+}
+
+// growChild 让n的第i个子节点至少有degree个key：从兄弟节点借一个key，兄弟节点也不够时合并。
+// 返回合并之后原来的子节点所在的位置
+func (t *btreeIndex) growChild(n *btreeNode, i int) int {
+	if i > 0 && len(n.children[i-1].items) >= btreeDegree {
+		left := t.mutableChild(n, i-1)
+		child := t.mutableChild(n, i)
+		child.insertItem(0, n.items[i-1])
+		n.items[i-1] = left.removeItem(len(left.items) - 1)
+		if !left.leaf() {
+			child.insertChild(0, left.removeChild(len(left.children)-1))
+		}
+		return i
+	}
+	if i < len(n.items) && len(n.children[i+1].items) >= btreeDegree {
+		right := t.mutableChild(n, i+1)
+		child := t.mutableChild(n, i)
+		child.items = append(child.items, n.items[i])
+		n.items[i] = right.removeItem(0)
+		if !right.leaf() {
+			child.children = append(child.children, right.removeChild(0))
+		}
+		return i
+	}
+	if i > 0 {
+		i--
+	}
+	t.mergeChildren(n, i)
+	return i
+}
+
+// mergeChildren 把n的第i个key和第i+1个子节点合并到第i个子节点中
+func (t *btreeIndex) mergeChildren(n *btreeNode, i int) {
+	left := t.mutableChild(n, i)
+	right := n.children[i+1]
+	left.items = append(left.items, n.removeItem(i))
+	left.items = append(left.items, right.items...)
+	left.children = append(left.children, right.children...)
+	n.removeChild(i + 1)
+}
@@ -0,0 +1,180 @@
+package bitcask
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// Codec compresses values before they are written and decompresses them on read.
+// The ID is stored with every record, so it must never be reused for a different
+// encoding once data has been written with it. Decode is given memory owned by
+// the database and must return a new slice rather than a sub-slice of data.
+type Codec interface {
+	ID() byte
+	Encode(value []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+// 内置编码的ID，自定义编码需要使用其他ID
+const (
+	CodecNone  byte = 0
+	CodecZlib  byte = 1
+	CodecFlate byte = 2
+)
+
+var (
+	// NoneCodec stores values as they are.
+	NoneCodec Codec = noneCodec{}
+	// ZlibCodec compresses values with zlib.
+	ZlibCodec Codec = zlibCodec{}
+	// FlateCodec compresses values with raw DEFLATE.
+	FlateCodec Codec = flateCodec{}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{
+		CodecNone:  NoneCodec,
+		CodecZlib:  ZlibCodec,
+		CodecFlate: FlateCodec,
+	}
+)
+
+// RegisterCodec makes a user-defined codec available for reading and writing.
+// It fails if a codec of a different type is already registered under the
+// same ID. Registering the same type again replaces the previous value.
+func RegisterCodec(c Codec) error {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	// 按动态类型比较，直接比较接口值在类型不可比较时会panic
+	if existing, ok := codecs[c.ID()]; ok && reflect.TypeOf(existing) != reflect.TypeOf(c) {
+		return fmt.Errorf("codec ID %d is already registered", c.ID())
+	}
+	codecs[c.ID()] = c
+	return nil
+}
+
+// lookupCodec 按ID查找已注册的编码
+func lookupCodec(id byte) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCodec, id)
+	}
+	return c, nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) ID() byte                            { return CodecNone }
+func (noneCodec) Encode(value []byte) ([]byte, error) { return value, nil }
+func (noneCodec) Decode(data []byte) ([]byte, error)  { return data, nil }
+
+type zlibCodec struct{}
+
+func (zlibCodec) ID() byte { return CodecZlib }
+
+func (zlibCodec) Encode(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(value); err != nil {
+		return nil, fmt.Errorf("failed to compress data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress data: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (zlibCodec) Decode(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zlib reader: %w", err)
+	}
+	defer r.Close()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return nil, fmt.Errorf("failed to decompress data: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+type flateCodec struct{}
+
+func (flateCodec) ID() byte { return CodecFlate }
+
+func (flateCodec) Encode(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(value); err != nil {
+		return nil, fmt.Errorf("failed to compress data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress data: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decode(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return nil, fmt.Errorf("failed to decompress data: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// valueCodec 返回写入新记录时使用的编码
+func (b *Bitcask) valueCodec() Codec {
+	if b.config.Codec != nil {
+		return b.config.Codec
+	}
+	if b.config.CompressData {
+		return ZlibCodec
+	}
+	return NoneCodec
+}
+
+// encodeValue 按配置的编码压缩值，返回实际使用的编码ID。
+// 小于MinCompressSize的值，或者压缩后没有变小的值按原样保存。
+func (b *Bitcask) encodeValue(value []byte) (byte, []byte, error) {
+	codec := b.valueCodec()
+	if codec.ID() == CodecNone || len(value) < b.config.MinCompressSize {
+		return CodecNone, value, nil
+	}
+
+	data, err := codec.Encode(value)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) >= len(value) {
+		return CodecNone, value, nil
+	}
+	return codec.ID(), data, nil
+}
+
+// decodeValue 按记录中保存的编码ID解码值
+func decodeValue(codecID byte, data []byte) ([]byte, error) {
+	if codecID == CodecNone {
+		return data, nil
+	}
+	codec, err := lookupCodec(codecID)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decode(data)
+}
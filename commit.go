@@ -0,0 +1,81 @@
+package bitcask
+
+// commitRequest 是等待组提交的一个写操作
+type commitRequest struct {
+	op   func() error
+	done chan error    // 操作完成并落盘后返回结果
+	lead chan struct{} // 轮到它作为leader执行下一组提交
+}
+
+// commit 在写锁下执行写操作op。SyncAlways策略下并发的写操作排队组成一组，
+// 由其中一个写者作为leader依次执行并只落盘一次，然后唤醒同组的其他写者。
+// 写锁一直持有到落盘之后，因此读者看不到还没有落盘的数据。
+func (b *Bitcask) commit(op func() error) error {
+	if b.config.SyncPolicy.mode != syncAlways {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if b.closed {
+			return ErrClosed
+		}
+		return op()
+	}
+
+	req := &commitRequest{op: op, done: make(chan error, 1), lead: make(chan struct{}, 1)}
+	b.commitMu.Lock()
+	b.commitQueue = append(b.commitQueue, req)
+	leader := !b.committing
+	b.committing = true
+	b.commitMu.Unlock()
+
+	if !leader {
+		select {
+		case err := <-req.done:
+			return err
+		case <-req.lead:
+		}
+	}
+
+	// 作为leader提交队列中已有的写操作，自己的操作也在其中
+	b.commitGroup()
+	return <-req.done
+}
+
+// commitGroup 取出队列中所有的写操作一起执行并落盘，之后把leader交给队列中下一个等待的写者
+func (b *Bitcask) commitGroup() {
+	b.commitMu.Lock()
+	group := b.commitQueue
+	b.commitQueue = nil
+	b.commitMu.Unlock()
+
+	b.mutex.Lock()
+	errs := make([]error, len(group))
+	written := false
+	for i, req := range group {
+		if b.closed {
+			errs[i] = ErrClosed
+			continue
+		}
+		errs[i] = req.op()
+		written = written || errs[i] == nil
+	}
+	var syncErr error
+	if written {
+		syncErr = b.syncActiveFile()
+	}
+	b.mutex.Unlock()
+
+	for i, req := range group {
+		if errs[i] == nil {
+			errs[i] = syncErr
+		}
+		req.done <- errs[i]
+	}
+
+	b.commitMu.Lock()
+	if len(b.commitQueue) == 0 {
+		b.committing = false
+	} else {
+		b.commitQueue[0].lead <- struct{}{}
+	}
+	b.commitMu.Unlock()
+}
@@ -1,21 +1,46 @@
 package bitcask
 
-import "time"
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"time"
+)
 
 type ConfOption func(*Config)
 
 // Config is the configuration for a Bitcask instance.
 type Config struct {
-	MaxFileSize    int64
-	MergeThreshold int
-	SyncWrites     bool
-	CompressData   bool
-	MergeInterval  time.Duration
+	MaxFileSize         int64
+	MergeThreshold      int
+	MergeRatio          float64
+	MergeMinReclaimable int64
+	SyncWrites          bool
+	SyncPolicy          SyncPolicy
+	WriteBufferSize     int
+	CompressData        bool
+	Codec               Codec
+	MinCompressSize     int
+	MergeInterval       time.Duration
+	DisableAutoMerge    bool
+	MergeScheduler      Scheduler
+	BackgroundIORate    int64
+	BackgroundIOBurst   int64
+	VerifyChecksum      bool
+	Logger              *log.Logger
+	LockTimeout         time.Duration
+	ReadOnly            bool
+	NewIndex            func() Index
 }
 
 // DefaultMaxDatafileSize is the default maximum size of a datafile.
 const DefaultMaxDatafileSize = 1020 * 1024 * 10
 
+// DefaultWriteBufferSize is a reasonable size to pass to WriteBufferSize.
+// Records are not buffered unless WriteBufferSize is set.
+const DefaultWriteBufferSize = 64 * 1024
+
 // MaxDatafileSize sets the maximum size of a datafile.
 func MaxDatafileSize(size int64) ConfOption {
 	return func(c *Config) {
@@ -23,27 +48,85 @@ func MaxDatafileSize(size int64) ConfOption {
 	}
 }
 
-// MergeThreshold sets the threshold for merging datafiles.
+// MergeThreshold sets the minimum number of data files before background merges
+// run. The default of zero leaves the decision to MergeRatio and
+// MergeMinReclaimable, so a few badly fragmented files are merged as well.
 func MergeThreshold(threshold int) ConfOption {
 	return func(c *Config) {
 		c.MergeThreshold = threshold
 	}
 }
 
-// SyncWrites sets whether to sync writes to disk.
+// MergeRatio sets the minimum fraction of dead bytes a sealed data file must
+// hold to be selected for merging.
+func MergeRatio(ratio float64) ConfOption {
+	return func(c *Config) {
+		c.MergeRatio = ratio
+	}
+}
+
+// MergeMinReclaimable sets the minimum number of dead bytes the selected files
+// must hold in total for a merge to run.
+func MergeMinReclaimable(bytes int64) ConfOption {
+	return func(c *Config) {
+		c.MergeMinReclaimable = bytes
+	}
+}
+
+// SyncWrites sets whether to sync writes to disk. SyncWrites(true) is the same
+// as WithSyncPolicy(SyncAlways()) and SyncWrites(false) as WithSyncPolicy(SyncNever()).
 func SyncWrites(sync bool) ConfOption {
 	return func(c *Config) {
 		c.SyncWrites = sync
+		if sync {
+			c.SyncPolicy = SyncAlways()
+		} else {
+			c.SyncPolicy = SyncNever()
+		}
 	}
 }
 
-// CompressData sets whether to compress data.
+// WithSyncPolicy sets when writes are flushed and fsynced to disk.
+func WithSyncPolicy(policy SyncPolicy) ConfOption {
+	return func(c *Config) {
+		c.SyncPolicy = policy
+		c.SyncWrites = policy.mode == syncAlways
+	}
+}
+
+// WriteBufferSize sets how many bytes of records are buffered in memory before
+// they are written to the active data file. Zero, the default, writes every
+// record through.
+func WriteBufferSize(size int) ConfOption {
+	return func(c *Config) {
+		c.WriteBufferSize = size
+	}
+}
+
+// CompressData sets whether to compress data with zlib.
+// It is ignored when a codec is set with Compression.
 func CompressData(compress bool) ConfOption {
 	return func(c *Config) {
 		c.CompressData = compress
 	}
 }
 
+// Compression sets the codec used to compress new values. The codec ID is
+// stored with every record, so values written with another codec stay readable
+// as long as that codec is registered.
+func Compression(codec Codec) ConfOption {
+	return func(c *Config) {
+		c.Codec = codec
+	}
+}
+
+// MinCompressSize sets the value size in bytes below which values are stored uncompressed.
+func MinCompressSize(size int) ConfOption {
+	return func(c *Config) {
+		c.MinCompressSize = size
+	}
+}
+
 // MergeInterval sets the interval for merging datafiles.
 func MergeInterval(interval time.Duration) ConfOption {
 	return func(c *Config) {
@@ -51,13 +134,100 @@ func MergeInterval(interval time.Duration) ConfOption {
 	}
 }
 
+// DisableAutoMerge turns off background merging. Merges then only run when
+// Merge is called.
+func DisableAutoMerge() ConfOption {
+	return func(c *Config) {
+		c.DisableAutoMerge = true
+	}
+}
+
+// Scheduler runs automatic merges for a database. It is started in its own
+// goroutine by Open and should call db.Merge whenever a merge is due. ctx is
+// cancelled by Close, which waits for the scheduler to return.
+type Scheduler func(ctx context.Context, db *Bitcask)
+
+// MergeScheduler replaces the built-in interval-based merge scheduler.
+func MergeScheduler(s Scheduler) ConfOption {
+	return func(c *Config) {
+		c.MergeScheduler = s
+	}
+}
+
+// BackgroundIORate limits the disk bandwidth used by merges and snapshots to
+// bytesPerSecond, shared between all background jobs. burst is the number of
+// bytes that can be used at once after a quiet period; zero means one second's
+// worth. A rate of zero disables the limit.
+func BackgroundIORate(bytesPerSecond, burst int64) ConfOption {
+	return func(c *Config) {
+		c.BackgroundIORate = bytesPerSecond
+		c.BackgroundIOBurst = burst
+	}
+}
+
+// VerifyChecksums sets whether Get verifies the CRC of each record it reads.
+// Disabling it trades corruption detection for read speed.
+func VerifyChecksums(verify bool) ConfOption {
+	return func(c *Config) {
+		c.VerifyChecksum = verify
+	}
+}
+
+// Logger sets the logger used to report recovery actions. A nil logger
+// turns logging off.
+func Logger(logger *log.Logger) ConfOption {
+	return func(c *Config) {
+		if logger == nil {
+			logger = log.New(io.Discard, "", 0)
+		}
+		c.Logger = logger
+	}
+}
+
+// LockTimeout sets how long Open waits for another process to release the
+// database directory. Zero fails immediately with ErrDatabaseLocked and a
+// negative duration waits indefinitely.
+func LockTimeout(timeout time.Duration) ConfOption {
+	return func(c *Config) {
+		c.LockTimeout = timeout
+	}
+}
+
+// ReadOnly opens the database without taking the directory lock, creating an
+// active file, merging or writing hint files. Write operations return ErrReadOnly.
+// Records a writer still holds in its write buffer are not visible; see Sync.
+func ReadOnly() ConfOption {
+	return func(c *Config) {
+		c.ReadOnly = true
+	}
+}
+
+// WithIndex sets the constructor for the in-memory key index. The default
+// NewBTreeIndex keeps keys ordered; NewHashIndex speeds up point lookups when
+// ordered scans are not needed. Any other Index implementation can be plugged
+// in the same way. A nil constructor restores the default.
+func WithIndex(newIndex func() Index) ConfOption {
+	return func(c *Config) {
+		if newIndex == nil {
+			newIndex = NewBTreeIndex
+		}
+		c.NewIndex = newIndex
+	}
+}
+
 // DefaultConfig returns the default configuration.
 func DefaultConfig() *Config {
 	return &Config{
-		MaxFileSize:    DefaultMaxDatafileSize,
-		MergeThreshold: 10,
-		SyncWrites:     false,
-		CompressData:   false,
-		MergeInterval:  time.Minute * 10,
+		MaxFileSize:     DefaultMaxDatafileSize,
+		MergeThreshold:  0,
+		MergeRatio:      0.5,
+		SyncWrites:      false,
+		SyncPolicy:      SyncNever(),
+		WriteBufferSize: 0,
+		CompressData:    false,
+		MergeInterval:   time.Minute * 10,
+		VerifyChecksum:  true,
+		NewIndex:        NewBTreeIndex,
+		Logger:          log.New(os.Stderr, "bitcask: ", log.LstdFlags),
 	}
 }
@@ -58,6 +58,7 @@ func main() {
 
 	// 遍历键
 	iterator := db.Iterator()
+	defer iterator.Close()
 	for iterator.Next() {
 		key := iterator.Key()
 		value, err := iterator.Value()
@@ -2,12 +2,14 @@ package bitcask
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"golang.org/x/sys/unix"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -19,22 +21,47 @@ func (b *Bitcask) openNewActiveFile() error {
 	}
 
 	b.activeFileID = time.Now().UnixNano()
-	filename := b.getDataFilePath(b.activeFileID)
-	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	file, err := b.createDataFile(b.getDataFilePath(b.activeFileID), b.dataFileOptions())
 	if err != nil {
 		return err
 	}
 	b.activeFile = file
 
-	// 创建对应的hint文件
-	hintFilename := b.getHintFilePath(b.activeFileID)
-	hintFile, err := os.Create(hintFilename)
+	// hint文件在数据文件写满封存时才生成
+	return b.mapActiveFile()
+}
+
+// rotateActiveFile 封存当前活动文件并切换到一个新的活动文件
+func (b *Bitcask) rotateActiveFile() error {
+	if b.activeFile != nil {
+		// 封存之前写入缓冲中的记录，除SyncNever之外的策略还需要落盘，之后不会再回到这个文件
+		var err error
+		if b.config.SyncPolicy.mode == syncNever {
+			err = b.flush()
+		} else {
+			err = b.syncActiveFile()
+		}
+		if err != nil {
+			return err
+		}
+		if err := b.sealActiveFile(); err != nil {
+			return fmt.Errorf("failed to seal active file: %w", err)
+		}
+	}
+	return b.openNewActiveFile()
+}
+
+// sealActiveFile 为活动文件生成hint文件
+func (b *Bitcask) sealActiveFile() error {
+	entries := make(map[string]hintRecord)
+	err := b.scanDataFile(b.activeFileID, func(key string, h hintRecord) error {
+		entries[key] = h
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	hintFile.Close()
-
-	return nil
+	return b.writeHintFile(b.activeFileID, entries)
 }
 
 func (b *Bitcask) getDataFilePath(fileID int64) string {
@@ -45,6 +72,17 @@ func (b *Bitcask) getHintFilePath(fileID int64) string {
 	return filepath.Join(b.directory, fmt.Sprintf("%d.hint", fileID))
 }
 
+// syncDir 将目录中文件的创建、重命名和删除落盘
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// copyFile 复制整个文件，复制速度受后台I/O限速控制
 func (b *Bitcask) copyFile(src, dst string) error {
 	sourceFile, err := os.Open(src)
 	if err != nil {
@@ -58,58 +96,64 @@ func (b *Bitcask) copyFile(src, dst string) error {
 	}
 	defer destFile.Close()
 
-	_, err = io.Copy(destFile, sourceFile)
+	_, err = io.Copy(&limitedWriter{ctx: context.Background(), w: destFile, limiter: b.ioLimiter}, sourceFile)
 	return err
 }
 
-func (b *Bitcask) mmapFile(file *os.File) (*MmapedFile, error) {
-	fi, err := file.Stat()
-	if err != nil {
-		return nil, err
-	}
-
-	size := fi.Size()
-	if size == 0 {
-		return &MmapedFile{data: []byte{}, file: file}, nil
-	}
-
-	data, err := unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
-	if err != nil {
-		return nil, err
-	}
-
-	return &MmapedFile{data: data, file: file}, nil
-}
-
-func (b *Bitcask) unmmapFile(mf *MmapedFile) error {
-	if mf.data != nil {
-		if err := unix.Munmap(mf.data); err != nil {
-			return err
-		}
-		mf.data = nil
-	}
-	return mf.file.Close()
-}
-
 func (b *Bitcask) loadExistingFiles() error {
 	files, err := filepath.Glob(filepath.Join(b.directory, "*.data"))
 	if err != nil {
 		return fmt.Errorf("failed to glob data files: %w", err)
 	}
 
+	fileIDs := make([]int64, 0, len(files))
 	for _, file := range files {
 		fileID, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(file), ".data"), 10, 64)
 		if err != nil {
 			return fmt.Errorf("invalid file name: %s", file)
 		}
+		fileIDs = append(fileIDs, fileID)
+	}
+	// 按文件ID从旧到新加载，新文件中的记录覆盖旧文件
+	sort.Slice(fileIDs, func(i, j int) bool { return fileIDs[i] < fileIDs[j] })
 
+	for i, fileID := range fileIDs {
 		if fileID > b.activeFileID {
 			b.activeFileID = fileID
 		}
 
-		if err := b.loadHintFile(fileID); err != nil {
+		// 映射数据文件时会校验文件头，旧格式或无法识别的版本直接拒绝打开
+		if err := b.updateMmap(fileID); err != nil {
+			return fmt.Errorf("failed to mmap data file %d: %w", fileID, err)
+		}
+
+		err := b.loadHintFile(fileID)
+		var corruptErr *CorruptError
+		if i == len(fileIDs)-1 && errors.As(err, &corruptErr) &&
+			!validRecordAfter(b.mmapedFiles[fileID].bytes()[corruptErr.Offset:]) {
+			// 最新的数据文件可能因为写入过程中崩溃而留下不完整的记录，
+			// 只读模式下它也可能是另一个进程正在写入的记录，直接忽略。
+			// 损坏的记录之后还有完整的记录时不是写到一半，不能截断
+			if b.config.ReadOnly {
+				err = nil
+			} else {
+				err = b.discardTornTail(fileID, corruptErr.Offset)
+			}
+		}
+		if err != nil {
 			return fmt.Errorf("failed to load hint file for %d: %w", fileID, err)
 		}
+
+		// 截断不完整的记录之后再统计文件大小
+		fi, err := os.Stat(b.getDataFilePath(fileID))
+		if err != nil {
+			return fmt.Errorf("failed to stat data file %d: %w", fileID, err)
+		}
+		size := fi.Size()
+		if b.config.ReadOnly {
+			size = b.mmapedFiles[fileID].size
+		}
+		b.stat(fileID).size = size - fileHeaderSize
 	}
 
 	return nil
@@ -128,8 +172,14 @@ func (b *Bitcask) loadHintFile(fileID int64) error {
 	defer file.Close()
 
 	reader := bufio.NewReader(file)
+	if _, err := readFileHeader(reader, fileKindHint); err != nil {
+		// hint文件只是加速恢复，格式不对时从数据文件重建
+		file.Close()
+		return b.rebuildHintFile(fileID)
+	}
+
 	for {
-		record := make([]byte, 32) // key size (4) + value size (4) + value pos (8) + timestamp (8) + file id (8)
+		record := make([]byte, hintEntrySize)
 		_, err := io.ReadFull(reader, record)
 		if err == io.EOF {
 			break
@@ -143,31 +193,53 @@ func (b *Bitcask) loadHintFile(fileID int64) error {
 		valuePos := int64(binary.BigEndian.Uint64(record[8:16]))
 		timestamp := int64(binary.BigEndian.Uint64(record[16:24]))
 		entryFileID := int64(binary.BigEndian.Uint64(record[24:32]))
+		recordType := record[32]
+		expiry := int64(binary.BigEndian.Uint64(record[33:41]))
 
 		key := make([]byte, keySize)
 		if _, err := io.ReadFull(reader, key); err != nil {
 			return fmt.Errorf("failed to read key: %w", err)
 		}
 
-		b.keydir[string(key)] = entry{
-			fileID:    entryFileID,
-			valueSize: valueSize,
-			valuePos:  valuePos,
-			timestamp: timestamp,
-		}
+		b.applyHint(string(key), hintRecord{
+			Entry: Entry{
+				fileID:    entryFileID,
+				valueSize: valueSize,
+				valuePos:  valuePos,
+				timestamp: timestamp,
+				expiry:    expiry,
+			},
+			recordType: recordType,
+		})
 	}
 
 	return nil
 }
 
-func (b *Bitcask) writeHintEntry(hintFile *os.File, key string, e entry) error {
-	hintEntry := make([]byte, 32)
+// applyHint 将一条hint记录应用到keydir，墓碑记录和已过期的值会删除对应的key
+func (b *Bitcask) applyHint(key string, h hintRecord) {
+	if h.recordType == recordTypeTombstone {
+		b.addTombstone(h.fileID, key)
+		b.deleteKey(key)
+		return
+	}
+	if h.expired(time.Now().UnixNano()) {
+		b.deleteKey(key)
+		return
+	}
+	b.setKey(key, h.Entry)
+}
+
+func (b *Bitcask) writeHintEntry(hintFile *os.File, key string, h hintRecord) error {
+	hintEntry := make([]byte, hintEntrySize)
 
 	binary.BigEndian.PutUint32(hintEntry[:4], uint32(len(key)))
-	binary.BigEndian.PutUint32(hintEntry[4:8], uint32(e.valueSize))
-	binary.BigEndian.PutUint64(hintEntry[8:16], uint64(e.valuePos))
-	binary.BigEndian.PutUint64(hintEntry[16:24], uint64(e.timestamp))
-	binary.BigEndian.PutUint64(hintEntry[24:32], uint64(e.fileID))
+	binary.BigEndian.PutUint32(hintEntry[4:8], uint32(h.valueSize))
+	binary.BigEndian.PutUint64(hintEntry[8:16], uint64(h.valuePos))
+	binary.BigEndian.PutUint64(hintEntry[16:24], uint64(h.timestamp))
+	binary.BigEndian.PutUint64(hintEntry[24:32], uint64(h.fileID))
+	hintEntry[32] = h.recordType
+	binary.BigEndian.PutUint64(hintEntry[33:41], uint64(h.expiry))
 
 	if _, err := hintFile.Write(hintEntry); err != nil {
 		return err
@@ -178,58 +250,193 @@ func (b *Bitcask) writeHintEntry(hintFile *os.File, key string, e entry) error {
 	return nil
 }
 
-func (b *Bitcask) rebuildHintFile(fileID int64) error {
-	dataPath := b.getDataFilePath(fileID)
-	file, err := os.Open(dataPath)
+// discardTornTail 将数据文件offset之后的内容移到隔离文件中，并把数据文件截断到最后一条完整的记录
+func (b *Bitcask) discardTornTail(fileID int64, offset int64) error {
+	file, err := os.OpenFile(b.getDataFilePath(fileID), os.O_RDWR, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to open data file: %w", err)
 	}
 	defer file.Close()
 
-	hintPath := b.getHintFilePath(fileID)
-	hintFile, err := os.Create(hintPath)
+	fi, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat data file: %w", err)
+	}
+
+	tail := make([]byte, fi.Size()-offset)
+	if _, err := file.ReadAt(tail, offset); err != nil {
+		return fmt.Errorf("failed to read torn tail: %w", err)
+	}
+
+	quarantinePath := filepath.Join(b.directory, fmt.Sprintf("%d-%d.torn", fileID, offset))
+	if err := os.WriteFile(quarantinePath, tail, 0644); err != nil {
+		return fmt.Errorf("failed to write quarantine file: %w", err)
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate data file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync data file: %w", err)
+	}
+
+	b.config.Logger.Printf("discarded %d bytes after offset %d in data file %d, moved to %s",
+		len(tail), offset, fileID, quarantinePath)
+	return nil
+}
+
+// writeHintFile 将entries写入fileID对应的hint文件
+func (b *Bitcask) writeHintFile(fileID int64, entries map[string]hintRecord) error {
+	return b.writeHintFileAt(b.getHintFilePath(fileID), entries)
+}
+
+// writeHintFileAt 将entries写入hintPath，先写临时文件并落盘再重命名，保证hint文件要么完整要么不存在
+func (b *Bitcask) writeHintFileAt(hintPath string, entries map[string]hintRecord) error {
+	tmpPath := hintPath + ".tmp"
+	hintFile, err := os.Create(tmpPath)
 	if err != nil {
 		return fmt.Errorf("failed to create hint file: %w", err)
 	}
-	defer hintFile.Close()
+	defer os.Remove(tmpPath)
 
-	reader := bufio.NewReader(file)
+	if _, err := hintFile.Write(encodeFileHeader(fileHeader{version: formatVersion, kind: fileKindHint})); err != nil {
+		hintFile.Close()
+		return fmt.Errorf("failed to write hint file header: %w", err)
+	}
+
+	for k, e := range entries {
+		if err := b.writeHintEntry(hintFile, k, e); err != nil {
+			hintFile.Close()
+			return fmt.Errorf("failed to write hint entry: %w", err)
+		}
+	}
+	if err := hintFile.Sync(); err != nil {
+		hintFile.Close()
+		return fmt.Errorf("failed to sync hint file: %w", err)
+	}
+	if err := hintFile.Close(); err != nil {
+		return fmt.Errorf("failed to close hint file: %w", err)
+	}
+
+	return os.Rename(tmpPath, hintPath)
+}
+
+func (b *Bitcask) rebuildHintFile(fileID int64) error {
+	entries := make(map[string]hintRecord)
+	err := b.scanDataFile(fileID, func(key string, h hintRecord) error {
+		// 更新keydir
+		b.applyHint(key, h)
+		entries[key] = h
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if b.config.ReadOnly {
+		return nil
+	}
+
+	return b.writeHintFile(fileID, entries)
+}
+
+// scannedRecord 是扫描时暂存的批量写入记录
+type scannedRecord struct {
+	key string
+	h   hintRecord
+}
+
+// scanDataFile 顺序读取数据文件，对每条已提交的记录调用fn。
+// 批量写入的记录会暂存到读到对应的提交记录为止，没有提交记录的批量写入会被丢弃。
+func (b *Bitcask) scanDataFile(fileID int64, fn func(key string, h hintRecord) error) error {
+	file, err := os.Open(b.getDataFilePath(fileID))
+	if err != nil {
+		return fmt.Errorf("failed to open data file: %w", err)
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat data file: %w", err)
+	}
+	size := fi.Size()
+	// 只读模式下其他进程可能还在追加写入，只扫描已经映射的部分，
+	// 否则索引会指向映射范围之外的记录。合并扫描时不持有锁，只在只读模式下访问mmapedFiles
+	if b.config.ReadOnly {
+		if mf, ok := b.mmapedFiles[fileID]; ok && mf.size < size {
+			size = mf.size
+		}
+	}
+
+	reader := bufio.NewReader(io.LimitReader(file, size))
+	if _, err := readFileHeader(reader, fileKindData); err != nil {
+		return fmt.Errorf("failed to read file header: %w", err)
+	}
+
+	pending := make(map[uint64][]scannedRecord)
+	offset := int64(fileHeaderSize)
 	for {
 		header := make([]byte, headerSize)
 		_, err := io.ReadFull(reader, header)
 		if err == io.EOF {
 			break
 		}
+		if err == io.ErrUnexpectedEOF {
+			return &CorruptError{FileID: fileID, Offset: offset}
+		}
 		if err != nil {
 			return fmt.Errorf("failed to read header: %w", err)
 		}
+		h := decodeRecordHeader(header)
 
-		timestamp := int64(binary.BigEndian.Uint64(header[4:]))
-		keySize := int(binary.BigEndian.Uint32(header[12:]))
-		valueSize := int32(binary.BigEndian.Uint32(header[16:]))
-
-		key := make([]byte, keySize)
-		if _, err := io.ReadFull(reader, key); err != nil {
-			return fmt.Errorf("failed to read key: %w", err)
+		// 记录长度超出文件末尾，说明记录没有写完整或者头部已损坏
+		if offset+h.size() > size {
+			return &CorruptError{FileID: fileID, Offset: offset}
 		}
 
-		valuePos, _ := file.Seek(0, io.SeekCurrent)
-
-		// 更新keydir
-		et := entry{
-			fileID:    fileID,
-			valueSize: valueSize,
-			valuePos:  valuePos,
-			timestamp: timestamp,
+		record := make([]byte, h.size())
+		copy(record, header)
+		if _, err := io.ReadFull(reader, record[headerSize:]); err != nil {
+			return fmt.Errorf("failed to read record: %w", err)
+		}
+		if !validChecksum(record) {
+			return &CorruptError{FileID: fileID, Offset: offset}
+		}
+		key := record[headerSize : headerSize+h.keySize]
+		value := record[headerSize+h.keySize:]
+
+		hr := hintRecord{
+			Entry: Entry{
+				fileID:    fileID,
+				valueSize: int32(h.valueSize),
+				valuePos:  offset + headerSize + int64(h.keySize),
+				timestamp: h.timestamp,
+				expiry:    h.expiry,
+			},
+			recordType: h.recordType,
+		}
+		offset += h.size()
+
+		if h.recordType == recordTypeBatchCommit {
+			records := pending[h.batchID]
+			delete(pending, h.batchID)
+			if len(value) != 4 || int(binary.BigEndian.Uint32(value)) != len(records) {
+				continue
+			}
+			for _, r := range records {
+				if err := fn(r.key, r.h); err != nil {
+					return err
+				}
+			}
+			continue
 		}
-		b.keydir[string(key)] = et
 
-		if err := b.writeHintEntry(hintFile, string(key), et); err != nil {
-			return fmt.Errorf("failed to write hint entry: %w", err)
+		if h.batchID != 0 {
+			pending[h.batchID] = append(pending[h.batchID], scannedRecord{key: string(key), h: hr})
+			continue
 		}
-		// 跳过值
-		if _, err := file.Seek(int64(valueSize), io.SeekCurrent); err != nil {
-			return fmt.Errorf("failed to seek past value: %w", err)
+		if err := fn(string(key), hr); err != nil {
+			return err
 		}
 	}
 
@@ -244,62 +451,16 @@ func (b *Bitcask) openActiveFile(fileID int64) error {
 	}
 	b.activeFile = file
 	b.activeFileID = fileID
-	return nil
-}
 
-func (b *Bitcask) updateMmap(fileID int64) error {
-	mf, ok := b.mmapedFiles[fileID]
-	if !ok {
-		// 如果内存映射不存在，创建一个新的
-		file, err := os.OpenFile(b.getDataFilePath(fileID), os.O_RDWR, 0644)
-		if err != nil {
-			return fmt.Errorf("failed to open data file for mmap: %w", err)
+	// 活动文件会继续追加写入，原有的hint文件不再完整。删除必须落盘，
+	// 否则断电之后旧的hint文件可能重新出现，之后追加的记录在恢复时不会被扫描
+	err = os.Remove(b.getHintFilePath(fileID))
+	if err == nil {
+		if err := syncDir(b.directory); err != nil {
+			return fmt.Errorf("failed to sync directory: %w", err)
 		}
-		mf, err = b.mmapFile(file)
-		if err != nil {
-			file.Close()
-			return fmt.Errorf("failed to mmap file: %w", err)
-		}
-		b.mmapedFiles[fileID] = mf
-		return nil
-	}
-
-	// 获取文件当前大小
-	fileInfo, err := mf.file.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to get file info: %w", err)
-	}
-
-	// 如果文件大小没有变化，不需要更新
-	if fileInfo.Size() == int64(len(mf.data)) {
-		return nil
-	}
-
-	// 解除旧的内存映射
-	if err := unix.Munmap(mf.data); err != nil {
-		return fmt.Errorf("failed to unmap old data: %w", err)
-	}
-
-	// 创建新的内存映射
-	data, err := unix.Mmap(int(mf.file.Fd()), 0, int(fileInfo.Size()), unix.PROT_READ, unix.MAP_SHARED)
-	if err != nil {
-		return fmt.Errorf("failed to mmap file: %w", err)
-	}
-
-	// 更新内存映射
-	mf.data = data
-	b.mmapedFiles[fileID] = mf
-
-	return nil
-}
-
-func (b *Bitcask) getActiveFileSize() int64 {
-	if b.activeFile == nil {
-		return 0
-	}
-	info, err := b.activeFile.Stat()
-	if err != nil {
-		return 0
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale hint file: %w", err)
 	}
-	return info.Size()
+	return b.mapActiveFile()
 }
@@ -0,0 +1,126 @@
+package bitcask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// formatVersion 是当前数据文件和hint文件的格式版本，格式变化时递增
+const formatVersion uint16 = 3
+
+const (
+	fileHeaderSize = 16 // 4(magic) + 2(version) + 1(kind) + 1(options) + 8(reserved)
+)
+
+var fileMagic = []byte("BCSK")
+
+// 文件类型
+const (
+	fileKindData byte = 1
+	fileKindHint byte = 2
+)
+
+// 文件创建时的选项，只用于记录创建时的配置，读取时以每条记录中的编码为准
+const (
+	optionCompressed byte = 1 << 0
+)
+
+// fileHeader is written at the beginning of every data and hint file.
+type fileHeader struct {
+	version uint16
+	kind    byte
+	options byte
+}
+
+func (h fileHeader) compressed() bool {
+	return h.options&optionCompressed != 0
+}
+
+func encodeFileHeader(h fileHeader) []byte {
+	buf := make([]byte, fileHeaderSize)
+	copy(buf[:4], fileMagic)
+	binary.BigEndian.PutUint16(buf[4:6], h.version)
+	buf[6] = h.kind
+	buf[7] = h.options
+	return buf
+}
+
+// decodeFileHeader 解析文件头。没有魔数的文件视为旧格式，需要先迁移；版本号比当前新的文件无法识别。
+func decodeFileHeader(buf []byte, kind byte) (fileHeader, error) {
+	if len(buf) < fileHeaderSize || !bytes.Equal(buf[:4], fileMagic) {
+		return fileHeader{}, ErrMigrationRequired
+	}
+
+	h := fileHeader{
+		version: binary.BigEndian.Uint16(buf[4:6]),
+		kind:    buf[6],
+		options: buf[7],
+	}
+	if h.version > formatVersion || h.kind != kind {
+		return h, fmt.Errorf("%w: version %d kind %d", ErrUnsupportedVersion, h.version, h.kind)
+	}
+	if h.version < formatVersion {
+		return h, ErrMigrationRequired
+	}
+	return h, nil
+}
+
+// readFileHeader 从文件开头读取并校验文件头
+func readFileHeader(r io.Reader, kind byte) (fileHeader, error) {
+	buf := make([]byte, fileHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return fileHeader{}, err
+	}
+	return decodeFileHeader(buf, kind)
+}
+
+// dataFileOptions 返回新数据文件的创建选项
+func (b *Bitcask) dataFileOptions() byte {
+	if b.valueCodec().ID() != CodecNone {
+		return optionCompressed
+	}
+	return 0
+}
+
+// createDataFile 在path创建一个带文件头的新数据文件。文件头先写入临时文件再重命名，
+// 因此目录中的数据文件总是有完整的文件头。文件和目录都落盘之后才返回，
+// 否则之后落盘的记录可能因为断电时文件本身没有落盘而整个丢失。
+func (b *Bitcask) createDataFile(path string, options byte) (*os.File, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("data file %s already exists", filepath.Base(path))
+	}
+
+	tmpPath := path + ".tmp"
+	header := encodeFileHeader(fileHeader{version: formatVersion, kind: fileKindData, options: options})
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tmpFile.Write(header); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+}
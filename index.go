@@ -0,0 +1,98 @@
+package bitcask
+
+import "sort"
+
+// Index maps every key to the Entry of its latest record. Bitcask holds its own
+// lock around every call, so implementations need not be safe for concurrent use.
+type Index interface {
+	Get(key string) (Entry, bool)
+	Set(key string, e Entry)
+	Delete(key string)
+	Len() int
+	// Clone returns a copy of the current contents. The copy is read by
+	// snapshots and iterators while the original keeps changing, so later
+	// changes to either one must not be visible in the other.
+	Clone() Index
+	// Ascend calls fn in key order for every key not less than from and
+	// stops when fn returns false.
+	Ascend(from string, fn func(key string, e Entry) bool)
+}
+
+// NewBTreeIndex returns the default index. It keeps keys sorted, so scans and
+// iterators visit them in order and range and prefix scans only touch the keys
+// they return.
+func NewBTreeIndex() Index {
+	return newBTreeIndex()
+}
+
+// NewHashIndex returns an index that keeps keys in a hash map. Point lookups
+// are faster, but scans and iterators sort the keys first, and read snapshots
+// copy the whole map on the next write.
+func NewHashIndex() Index {
+	return newHashIndex()
+}
+
+// hashIndex 用map实现keydir。Clone之后两者共享同一个map，先修改的一方复制整个map
+type hashIndex struct {
+	m      map[string]Entry
+	shared bool
+}
+
+func newHashIndex() *hashIndex {
+	return &hashIndex{m: make(map[string]Entry)}
+}
+
+func (h *hashIndex) Get(key string) (Entry, bool) {
+	e, ok := h.m[key]
+	return e, ok
+}
+
+func (h *hashIndex) Set(key string, e Entry) {
+	h.own()
+	h.m[key] = e
+}
+
+func (h *hashIndex) Delete(key string) {
+	if _, ok := h.m[key]; !ok {
+		return
+	}
+	h.own()
+	delete(h.m, key)
+}
+
+func (h *hashIndex) Len() int {
+	return len(h.m)
+}
+
+func (h *hashIndex) Clone() Index {
+	h.shared = true
+	return &hashIndex{m: h.m, shared: true}
+}
+
+func (h *hashIndex) Ascend(from string, fn func(key string, e Entry) bool) {
+	keys := make([]string, 0, len(h.m))
+	for k := range h.m {
+		if k >= from {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !fn(k, h.m[k]) {
+			return
+		}
+	}
+}
+
+// own 在修改之前调用，map和副本共享时先复制一份
+func (h *hashIndex) own() {
+	if !h.shared {
+		return
+	}
+	m := make(map[string]Entry, len(h.m))
+	for k, e := range h.m {
+		m[k] = e
+	}
+	h.m = m
+	h.shared = false
+}
@@ -1,15 +1,147 @@
 package bitcask
 
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// IteratorOptions restricts the keys an iterator visits and what it reads.
+type IteratorOptions struct {
+	// Lower is the smallest key visited, inclusive. Empty means no lower bound.
+	Lower string
+	// Upper is the key iteration stops at, exclusive. Empty means no upper bound.
+	Upper string
+	// Prefix limits iteration to keys starting with it.
+	Prefix string
+	// KeysOnly skips reading values: Value always returns nil, and the
+	// iterator holds no data files open.
+	KeysOnly bool
+}
+
+// Iterator visits the keys of a database or read snapshot in key order, as
+// they were when the iterator was created. A new iterator is positioned
+// before the first key, so
+//
+//	for it.Next() { ... }
+//
+// visits every key exactly once. Close must be called when done to release the
+// data files the iterator reads values from.
 type Iterator struct {
-	bitcask *Bitcask
-	keys    []string
-	index   int
+	snapshot *ReadSnapshot
+	owned    bool // 快照由迭代器创建，Close时释放
+	keysOnly bool
+	keys     []string // 按顺序排列
+	entries  []Entry
+	index    int
+	err      error
+	closed   bool
+}
+
+// Iterator creates an iterator over all key-value pairs in the Bitcask database, in key order.
+func (b *Bitcask) Iterator() *Iterator {
+	return b.NewIterator(IteratorOptions{})
+}
+
+// NewIterator creates an iterator over the key-value pairs selected by opts.
+// Unless KeysOnly is set, values are read from a snapshot taken now, so later
+// writes, deletes and merges do not affect the iteration.
+func (b *Bitcask) NewIterator(opts IteratorOptions) *Iterator {
+	if opts.KeysOnly {
+		b.mutex.RLock()
+		defer b.mutex.RUnlock()
+		if b.closed {
+			return &Iterator{index: -1, err: ErrClosed}
+		}
+		it := &Iterator{keysOnly: true, index: -1}
+		it.collect(b.keydir, time.Now().UnixNano(), opts)
+		return it
+	}
+
+	s, err := b.NewReadSnapshot()
+	if err != nil {
+		return &Iterator{index: -1, err: err}
+	}
+	it := s.NewIterator(opts)
+	it.owned = true
+	return it
+}
+
+// Iterator creates an iterator over all key-value pairs in the snapshot, in key order.
+func (s *ReadSnapshot) Iterator() *Iterator {
+	return s.NewIterator(IteratorOptions{})
+}
+
+// NewIterator creates an iterator over the key-value pairs in the snapshot
+// selected by opts. Closing it does not release the snapshot.
+func (s *ReadSnapshot) NewIterator(opts IteratorOptions) *Iterator {
+	it := &Iterator{snapshot: s, keysOnly: opts.KeysOnly, index: -1}
+	it.collect(s.keydir, s.at, opts)
+	return it
+}
+
+// collect 按顺序收集keydir中在范围内并且在now时没有过期的key
+func (it *Iterator) collect(keydir Index, now int64, opts IteratorOptions) {
+	from := opts.Lower
+	if opts.Prefix > from {
+		from = opts.Prefix
+	}
+	keydir.Ascend(from, func(key string, e Entry) bool {
+		if (opts.Upper != "" && key >= opts.Upper) || !strings.HasPrefix(key, opts.Prefix) {
+			return false
+		}
+		if !e.expired(now) {
+			it.keys = append(it.keys, key)
+			it.entries = append(it.entries, e)
+		}
+		return true
+	})
 }
 
 // Next advances the iterator to the next key-value pair.
 func (it *Iterator) Next() bool {
-	it.index++
-	return it.index < len(it.keys)
+	if it.closed || it.err != nil {
+		return false
+	}
+	if it.index < len(it.keys) {
+		it.index++
+	}
+	return it.Valid()
+}
+
+// Prev moves the iterator to the previous key-value pair. Together with
+// SeekToLast it iterates in reverse order.
+func (it *Iterator) Prev() bool {
+	if it.closed || it.err != nil {
+		return false
+	}
+	if it.index >= 0 {
+		it.index--
+	}
+	return it.Valid()
+}
+
+// Seek moves the iterator to the first key that is greater than or equal to key.
+func (it *Iterator) Seek(key string) bool {
+	it.index = sort.SearchStrings(it.keys, key)
+	return it.Valid()
+}
+
+// SeekToFirst moves the iterator to the first key.
+func (it *Iterator) SeekToFirst() bool {
+	it.index = 0
+	return it.Valid()
+}
+
+// SeekToLast moves the iterator to the last key.
+func (it *Iterator) SeekToLast() bool {
+	it.index = len(it.keys) - 1
+	return it.Valid()
+}
+
+// Valid reports whether the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return !it.closed && it.err == nil && it.index >= 0 && it.index < len(it.keys)
 }
 
 // Key returns the key of the current key-value pair.
@@ -17,7 +149,30 @@ func (it *Iterator) Key() string {
 	return it.keys[it.index]
 }
 
-// Value returns the value of the current key-value pair.
+// Value returns a copy of the value of the current key-value pair.
 func (it *Iterator) Value() ([]byte, error) {
-	return it.bitcask.Get(it.Key())
+	if it.closed {
+		return nil, ErrClosed
+	}
+	if it.keysOnly {
+		return nil, nil
+	}
+	return it.snapshot.read(it.keys[it.index], it.entries[it.index])
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the data files held by the iterator. It is safe to call more than once.
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	if it.owned {
+		it.snapshot.Release()
+	}
+	return nil
 }
@@ -0,0 +1,59 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const lockFileName = "LOCK"
+
+// lockRetryInterval 是等待目录锁时的重试间隔
+const lockRetryInterval = 10 * time.Millisecond
+
+// acquireLock 对数据目录加排他的flock锁，防止多个进程同时打开同一个数据库。
+// timeout为0时立即失败，大于0时最多等待timeout，小于0时一直等待。
+func acquireLock(dir string, timeout time.Duration) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if timeout < 0 {
+		if err := unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock directory: %w", err)
+		}
+		return file, nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			return file, nil
+		}
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock directory: %w", err)
+		}
+		if !time.Now().Before(deadline) {
+			file.Close()
+			return nil, ErrDatabaseLocked
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// releaseLock 释放目录锁
+func releaseLock(file *os.File) error {
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_UN); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -1,115 +1,579 @@
 package bitcask
 
 import (
-	"encoding/binary"
+	"context"
 	"fmt"
-	"hash/crc32"
-	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// periodicMerge periodically merges the database into a new file.
-func (b *Bitcask) periodicMerge() {
+const (
+	// mergeDirName 是合并结果的暂存目录
+	mergeDirName = "merge"
+	// mergeMarkerName 是合并结果全部落盘后写入暂存目录的完成标记
+	mergeMarkerName = "MERGE_COMPLETE"
+)
+
+// startMerger 启动后台合并，Close时取消ctx并等待它退出
+func (b *Bitcask) startMerger() {
+	if b.config.DisableAutoMerge {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.stopMerge = cancel
+	b.mergeWG.Add(1)
+	go func() {
+		defer b.mergeWG.Done()
+		if b.config.MergeScheduler != nil {
+			b.config.MergeScheduler(ctx, b)
+			return
+		}
+		b.periodicMerge(ctx)
+	}()
+}
+
+// periodicMerge periodically merges fragmented data files.
+func (b *Bitcask) periodicMerge(ctx context.Context) {
 	ticker := time.NewTicker(b.config.MergeInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		b.merge()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// 有文件的碎片率达到MergeRatio并且可回收的字节数足够时才合并，
+		// 设置了MergeThreshold时还要求数据文件数量达到阈值
+		b.mutex.RLock()
+		fileCount := len(b.mmapedFiles)
+		picked := b.pickMergeFiles(false)
+		b.mutex.RUnlock()
+		if len(picked) == 0 || fileCount < b.config.MergeThreshold {
+			continue
+		}
+
+		if _, err := b.Merge(ctx, MergeOptions{}); err != nil && ctx.Err() == nil {
+			b.config.Logger.Printf("merge failed: %v", err)
+		}
 	}
 }
 
-// merge 合并数据文件
-func (b *Bitcask) merge() error {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+// mergeProgressInterval 是两次进度回调之间至少处理的字节数
+const mergeProgressInterval = 1 << 20
 
-	// 获取所有数据文件
-	dataFiles, err := filepath.Glob(filepath.Join(b.directory, "*.data"))
-	if err != nil {
-		return err
+// MergeOptions controls a single call to Merge.
+type MergeOptions struct {
+	// Force merges every sealed file that contains dead bytes, ignoring
+	// MergeRatio and MergeMinReclaimable.
+	Force bool
+	// Progress, if set, is called from the merging goroutine as input files
+	// are processed.
+	Progress func(MergeProgress)
+}
+
+// MergeProgress reports how far a merge has got.
+type MergeProgress struct {
+	BytesProcessed int64
+	BytesTotal     int64
+	KeysRewritten  int
+}
+
+// MergeResult describes what a merge did.
+type MergeResult struct {
+	// FilesRemoved lists the IDs of the data files that were merged and deleted.
+	FilesRemoved []int64
+	// FilesCreated lists the IDs of the merged output files. Output rolls over
+	// to a new file at MaxFileSize; it is empty if every input record was dead.
+	FilesCreated   []int64
+	KeysRewritten  int
+	BytesReclaimed int64
+}
+
+// mergedRecord 记录合并时被重写的key在合并前后的位置，已过期而被丢弃的key没有新位置
+type mergedRecord struct {
+	key     string
+	old     Entry
+	new     Entry
+	expired bool
+}
+
+// Merge rewrites the live records of fragmented sealed data files into new
+// files, starting another one whenever the current file reaches MaxFileSize,
+// and deletes the old ones. The new files are listed in
+// MergeResult.FilesCreated. Reads and writes continue while the files are
+// rewritten. Merge stops early and leaves the database unchanged when ctx is
+// cancelled. It returns ErrClosed once Close has been called.
+func (b *Bitcask) Merge(ctx context.Context, opts MergeOptions) (MergeResult, error) {
+	if b.config.ReadOnly {
+		return MergeResult{}, ErrReadOnly
 	}
+	return b.merge(ctx, opts)
+}
 
-	if len(dataFiles) < b.config.MergeThreshold {
-		return nil
+// merge 合并碎片率达到阈值的已封存数据文件。重写数据时不持有写锁，
+// 只在最后替换keydir和文件时短暂加锁，期间的读写不受影响。
+func (b *Bitcask) merge(ctx context.Context, opts MergeOptions) (MergeResult, error) {
+	var result MergeResult
+
+	// 同一时间只允许一个合并
+	b.mergeMutex.Lock()
+	defer b.mergeMutex.Unlock()
+	if b.closed {
+		return result, ErrClosed
 	}
 
-	// 创建新的合并文件
-	mergedFileID := time.Now().UnixNano()
-	mergedFilename := b.getDataFilePath(mergedFileID)
-	mergedFile, err := os.Create(mergedFilename)
-	if err != nil {
-		return err
+	b.mutex.RLock()
+	activeFileID := b.activeFileID
+	inputs := b.pickMergeFiles(opts.Force)
+	inputSizes := make([]int64, len(inputs))
+	var inputBytes int64
+	for i, fileID := range inputs {
+		inputSizes[i] = b.fileStats(fileID).Size
+		inputBytes += inputSizes[i]
+	}
+	// 没有参与合并的最旧文件，比它新的文件中的墓碑可能还需要屏蔽它里面的旧值
+	oldestKept := activeFileID
+	for fileID := range b.mmapedFiles {
+		if fileID < oldestKept && !containsFileID(inputs, fileID) {
+			oldestKept = fileID
+		}
 	}
-	defer mergedFile.Close()
+	b.mutex.RUnlock()
 
-	mergedHintFilename := b.getHintFilePath(mergedFileID)
-	mergedHintFile, err := os.Create(mergedHintFilename)
-	if err != nil {
-		return err
+	if len(inputs) == 0 {
+		return result, nil
 	}
-	defer mergedHintFile.Close()
 
-	// 遍历所有key，写入最新的值到新文件
-	for key, record := range b.keydir {
-		if record.fileID == b.activeFileID {
-			continue // 跳过当前活跃文件中的条目
+	// 合并结果先写入暂存目录，全部落盘并写入完成标记之后才移到数据目录，
+	// 在此之前失败、取消或崩溃都只需要丢弃暂存目录
+	stagingDir := b.getMergeDir()
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		return result, fmt.Errorf("failed to create merge directory: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			os.RemoveAll(stagingDir)
 		}
+	}()
 
-		value, err := b.Get(key)
-		if err != nil {
-			return err
+	// 合并文件的ID必须大于所有被合并的文件，并且小于合并开始时的活动文件，
+	// 这样恢复时活动文件以及之后写入的值和墓碑会覆盖合并文件
+	out := &mergeOutput{
+		ctx:        ctx,
+		bitcask:    b,
+		dir:        stagingDir,
+		nextID:     inputs[len(inputs)-1] + 1,
+		limitID:    activeFileID,
+		tombstones: make(map[int64]int64),
+	}
+	defer out.abort()
+
+	progress := MergeProgress{BytesTotal: inputBytes}
+	var reported int64
+	report := func() {
+		if opts.Progress != nil {
+			opts.Progress(progress)
 		}
+		reported = progress.BytesProcessed
+	}
+
+	// 已封存的文件不会再变化，可以不加写锁地逐条扫描
+	now := time.Now().UnixNano()
+	var merged []mergedRecord
+	for i, fileID := range inputs {
+		fileStart := progress.BytesProcessed
+		err := b.scanDataFile(fileID, func(key string, hr hintRecord) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := b.ioLimiter.wait(ctx, int(recordSize(key, hr.Entry))); err != nil {
+				return err
+			}
+			progress.BytesProcessed += recordSize(key, hr.Entry)
+			if progress.BytesProcessed-reported >= mergeProgressInterval {
+				report()
+			}
+
+			if hr.recordType == recordTypeTombstone {
+				// 只有存在更旧的未合并文件，并且key没有被重新写入时才需要保留墓碑
+				b.mutex.RLock()
+				_, live := b.keydir.Get(key)
+				b.mutex.RUnlock()
+				if live || oldestKept > hr.fileID {
+					return nil
+				}
+
+				_, err := out.write(key, recordHeader{timestamp: hr.timestamp, recordType: recordTypeTombstone}, nil)
+				return err
+			}
+			if hr.recordType != recordTypeValue {
+				return nil
+			}
 
-		// 写入数据
-		valuePos, err := mergedFile.Seek(0, io.SeekCurrent)
+			// 只有keydir仍然指向这条记录时才是有效值
+			b.mutex.RLock()
+			e, ok := b.keydir.Get(key)
+			if !ok || e.fileID != hr.fileID || e.valuePos != hr.valuePos {
+				b.mutex.RUnlock()
+				return nil
+			}
+			if e.expired(now) {
+				b.mutex.RUnlock()
+				merged = append(merged, mergedRecord{key: key, old: e, expired: true})
+				// 和墓碑一样，更旧的未合并文件中可能还有这个key的值，需要写墓碑屏蔽它
+				if oldestKept > hr.fileID {
+					return nil
+				}
+				_, err := out.write(key, recordHeader{timestamp: e.timestamp, recordType: recordTypeTombstone}, nil)
+				return err
+			}
+			// 原样复制编码后的值和编码ID，不做解压
+			h, value, err := b.readRecord(key, e)
+			if err == nil {
+				value = append([]byte(nil), value...)
+			}
+			b.mutex.RUnlock()
+			if err != nil {
+				return err
+			}
+
+			et, err := out.write(key, recordHeader{timestamp: e.timestamp, recordType: recordTypeValue, codec: h.codec, expiry: e.expiry}, value)
+			if err != nil {
+				return err
+			}
+			merged = append(merged, mergedRecord{key: key, old: e, new: et})
+			progress.KeysRewritten++
+			return nil
+		})
+		if err == nil {
+			err = ctx.Err()
+		}
 		if err != nil {
-			return err
+			return result, err
 		}
+		// 批量提交记录等不计入上面的统计，每个文件结束时按文件大小校正
+		progress.BytesProcessed = fileStart + inputSizes[i]
+		report()
+	}
 
-		header := make([]byte, headerSize)
-		binary.BigEndian.PutUint64(header[4:], uint64(record.timestamp))
-		binary.BigEndian.PutUint32(header[12:], uint32(len(key)))
-		binary.BigEndian.PutUint32(header[16:], uint32(len(value)))
+	// 被合并的文件中没有需要保留的记录时不产生合并文件
+	if err := out.seal(); err != nil {
+		return result, err
+	}
+	outputs := out.fileIDs
 
-		crc := crc32.ChecksumIEEE(append([]byte(key), value...))
-		binary.BigEndian.PutUint32(header[:4], crc)
+	// 完成标记写入之后合并就不能再回退，即使接下来崩溃，重新打开时也会继续完成
+	if err := b.writeMergeMarker(inputs, outputs); err != nil {
+		return result, err
+	}
+	committed = true
 
-		if _, err := mergedFile.Write(header); err != nil {
-			return err
-		}
-		if _, err := mergedFile.Write([]byte(key)); err != nil {
-			return err
+	if err := b.installMergeOutputs(outputs); err != nil {
+		return result, err
+	}
+	if err := b.swapMergedFiles(inputs, outputs, merged, out.tombstones); err != nil {
+		return result, err
+	}
+	if err := b.removeMergeInputs(inputs); err != nil {
+		return result, err
+	}
+
+	result.FilesRemoved = inputs
+	result.FilesCreated = outputs
+	result.KeysRewritten = progress.KeysRewritten
+	// 按磁盘上的文件大小计算，包括文件头
+	result.BytesReclaimed = inputBytes + int64(len(inputs))*fileHeaderSize - out.size
+	return result, nil
+}
+
+// mergeOutput 把合并结果写入暂存目录，当前文件写满MaxFileSize时切换到下一个文件，每个文件有自己的hint文件
+type mergeOutput struct {
+	ctx     context.Context
+	bitcask *Bitcask
+	dir     string
+	nextID  int64
+	limitID int64
+
+	file    *os.File
+	fileID  int64
+	offset  int64
+	entries map[string]hintRecord
+
+	fileIDs    []int64
+	size       int64           // 所有已完成的合并文件的总大小
+	tombstones map[int64]int64 // 每个合并文件中保留的墓碑记录的字节数
+}
+
+// write 追加一条记录，返回它在合并文件中的位置
+func (w *mergeOutput) write(key string, h recordHeader, value []byte) (Entry, error) {
+	data := encodeRecord(h, key, value)
+	if w.file != nil && w.offset > fileHeaderSize && w.offset+int64(len(data)) > w.bitcask.config.MaxFileSize {
+		if err := w.seal(); err != nil {
+			return Entry{}, err
 		}
-		if _, err := mergedFile.Write(value); err != nil {
-			return err
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return Entry{}, err
 		}
+	}
+	if err := w.bitcask.ioLimiter.wait(w.ctx, len(data)); err != nil {
+		return Entry{}, err
+	}
 
-		// 更新keydir
-		et := entry{
-			fileID:    mergedFileID,
-			valueSize: int32(len(value)),
-			valuePos:  valuePos + headerSize + int64(len(key)),
-			timestamp: record.timestamp,
+	if _, err := w.file.Write(data); err != nil {
+		return Entry{}, err
+	}
+	e := Entry{
+		fileID:    w.fileID,
+		valueSize: int32(len(value)),
+		valuePos:  w.offset + headerSize + int64(len(key)),
+		timestamp: h.timestamp,
+		expiry:    h.expiry,
+	}
+	w.offset += int64(len(data))
+	w.entries[key] = hintRecord{Entry: e, recordType: h.recordType}
+	if h.recordType == recordTypeTombstone {
+		w.tombstones[w.fileID] += int64(len(data))
+	}
+	return e, nil
+}
+
+// open 为下一个合并文件分配ID并创建文件
+func (w *mergeOutput) open() error {
+	b := w.bitcask
+	b.mutex.RLock()
+	for {
+		if _, ok := b.mmapedFiles[w.nextID]; !ok {
+			break
 		}
-		b.keydir[key] = et
+		w.nextID++
+	}
+	b.mutex.RUnlock()
+	if w.nextID >= w.limitID {
+		return fmt.Errorf("no file ID available for merged file")
+	}
 
-		// 写入hint文件
-		err = b.writeHintEntry(mergedHintFile, key, et)
-		if err != nil {
+	file, err := b.createDataFile(filepath.Join(w.dir, fmt.Sprintf("%d.data", w.nextID)), b.dataFileOptions())
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.fileID = w.nextID
+	w.nextID++
+	w.offset = fileHeaderSize
+	w.entries = make(map[string]hintRecord)
+	return nil
+}
+
+// seal 将当前合并文件落盘并生成hint文件
+func (w *mergeOutput) seal() error {
+	if w.file == nil {
+		return nil
+	}
+	file := w.file
+	w.file = nil
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := w.bitcask.writeHintFileAt(filepath.Join(w.dir, fmt.Sprintf("%d.hint", w.fileID)), w.entries); err != nil {
+		return err
+	}
+	w.fileIDs = append(w.fileIDs, w.fileID)
+	w.size += w.offset
+	return nil
+}
+
+// abort 关闭还没有完成的合并文件，文件本身随暂存目录一起删除
+func (w *mergeOutput) abort() {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
+
+// swapMergedFiles 加载合并文件并把keydir中的key指向它们，然后移除被合并的文件
+func (b *Bitcask) swapMergedFiles(inputs, outputs []int64, merged []mergedRecord, tombstones map[int64]int64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, fileID := range outputs {
+		if err := b.updateMmap(fileID); err != nil {
 			return err
 		}
+		st := b.stat(fileID)
+		st.size = b.mmapedFiles[fileID].size - fileHeaderSize
+		st.tombstones = tombstones[fileID]
 	}
 
-	// 删除旧文件
-	for _, file := range dataFiles {
-		if filepath.Base(file) != fmt.Sprintf("%d.data", b.activeFileID) {
-			os.Remove(file)
-			os.Remove(strings.TrimSuffix(file, ".data") + ".hint")
+	// 合并期间被覆盖或删除的key保持不变
+	for _, r := range merged {
+		if e, ok := b.keydir.Get(r.key); ok && e.fileID == r.old.fileID && e.valuePos == r.old.valuePos {
+			if r.expired {
+				b.deleteKey(r.key)
+			} else {
+				b.setKey(r.key, r.new)
+			}
 		}
 	}
 
+	// 正在读取这些文件的迭代器和快照持有映射的引用，映射在它们释放之后才解除
+	for _, fileID := range inputs {
+		b.removeMmap(fileID)
+		delete(b.fileStat, fileID)
+	}
 	return nil
 }
+
+func (b *Bitcask) getMergeDir() string {
+	return filepath.Join(b.directory, mergeDirName)
+}
+
+// writeMergeMarker 在暂存目录中写入完成标记，记录被合并的文件和合并产生的文件
+func (b *Bitcask) writeMergeMarker(inputs, outputs []int64) error {
+	stagingDir := b.getMergeDir()
+	// 标记之前的文件必须已经落盘
+	if err := syncDir(stagingDir); err != nil {
+		return fmt.Errorf("failed to sync merge directory: %w", err)
+	}
+
+	var buf strings.Builder
+	buf.WriteString("inputs")
+	for _, fileID := range inputs {
+		fmt.Fprintf(&buf, " %d", fileID)
+	}
+	buf.WriteString("\noutputs")
+	for _, fileID := range outputs {
+		fmt.Fprintf(&buf, " %d", fileID)
+	}
+	buf.WriteString("\n")
+
+	markerPath := filepath.Join(stagingDir, mergeMarkerName)
+	tmpPath := markerPath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create merge marker: %w", err)
+	}
+	if _, err := file.WriteString(buf.String()); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write merge marker: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync merge marker: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close merge marker: %w", err)
+	}
+	if err := os.Rename(tmpPath, markerPath); err != nil {
+		return fmt.Errorf("failed to rename merge marker: %w", err)
+	}
+	if err := syncDir(stagingDir); err != nil {
+		return fmt.Errorf("failed to sync merge directory: %w", err)
+	}
+	return syncDir(b.directory)
+}
+
+// readMergeMarker 读取完成标记，标记不存在时返回的错误满足os.IsNotExist
+func (b *Bitcask) readMergeMarker() (inputs, outputs []int64, err error) {
+	data, err := os.ReadFile(filepath.Join(b.getMergeDir(), mergeMarkerName))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var ids []int64
+		for _, field := range fields[1:] {
+			fileID, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid merge marker: %q", line)
+			}
+			ids = append(ids, fileID)
+		}
+		switch fields[0] {
+		case "inputs":
+			inputs = ids
+		case "outputs":
+			outputs = ids
+		default:
+			return nil, nil, fmt.Errorf("invalid merge marker: %q", line)
+		}
+	}
+	return inputs, outputs, nil
+}
+
+// installMergeOutputs 把暂存目录中的合并文件移到数据目录。已经移过去的文件会被跳过，因此可以重复执行。
+func (b *Bitcask) installMergeOutputs(outputs []int64) error {
+	stagingDir := b.getMergeDir()
+	for _, fileID := range outputs {
+		for _, dst := range []string{b.getDataFilePath(fileID), b.getHintFilePath(fileID)} {
+			src := filepath.Join(stagingDir, filepath.Base(dst))
+			if err := os.Rename(src, dst); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to install merged file: %w", err)
+			}
+		}
+	}
+	return syncDir(b.directory)
+}
+
+// removeMergeInputs 删除被合并的文件，最后删除暂存目录和其中的完成标记
+func (b *Bitcask) removeMergeInputs(inputs []int64) error {
+	for _, fileID := range inputs {
+		for _, path := range []string{b.getDataFilePath(fileID), b.getHintFilePath(fileID)} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove merged file: %w", err)
+			}
+		}
+	}
+	// 旧文件的删除落盘之后才能删除完成标记
+	if err := syncDir(b.directory); err != nil {
+		return err
+	}
+	return os.RemoveAll(b.getMergeDir())
+}
+
+// recoverMerge 处理上次没有完成的合并：写入了完成标记的合并继续完成，否则丢弃暂存的合并结果
+func (b *Bitcask) recoverMerge() error {
+	if _, err := os.Stat(b.getMergeDir()); os.IsNotExist(err) {
+		return nil
+	}
+
+	inputs, outputs, err := b.readMergeMarker()
+	if os.IsNotExist(err) {
+		b.config.Logger.Printf("discarding unfinished merge in %s", b.getMergeDir())
+		return os.RemoveAll(b.getMergeDir())
+	}
+	if err != nil {
+		return err
+	}
+
+	b.config.Logger.Printf("completing interrupted merge of %d files", len(inputs))
+	if err := b.installMergeOutputs(outputs); err != nil {
+		return err
+	}
+	return b.removeMergeInputs(inputs)
+}
+
+func containsFileID(fileIDs []int64, fileID int64) bool {
+	for _, id := range fileIDs {
+		if id == fileID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package bitcask
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// legacyHeaderSize 是没有文件头的旧格式中每条记录的头部大小：4(crc) + 8(timestamp) + 4(keySize) + 4(valueSize)
+const legacyHeaderSize = 20
+
+// Migrate rewrites the data files in dir that use an older on-disk format to
+// the current format, so that Open accepts the directory again. Files already
+// in the current format are left untouched and Migrate can be rerun after an
+// interruption. The options must describe how the old store was configured,
+// in particular whether CompressData was enabled.
+//
+// Files written before the format was versioned have no record types. Their
+// empty values, which Delete used to write, are converted to tombstones.
+func Migrate(dir string, opts ...ConfOption) error {
+	config := DefaultConfig()
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	lockFile, err := acquireLock(dir, config.LockTimeout)
+	if err != nil {
+		return err
+	}
+	defer releaseLock(lockFile)
+
+	b := &Bitcask{directory: dir, config: config}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.data"))
+	if err != nil {
+		return fmt.Errorf("failed to glob data files: %w", err)
+	}
+	for _, file := range files {
+		fileID, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(file), ".data"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid file name: %s", file)
+		}
+		if err := b.migrateDataFile(fileID); err != nil {
+			return fmt.Errorf("failed to migrate data file %d: %w", fileID, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateDataFile 将一个旧格式的数据文件重写为当前格式。新文件先写到临时文件，
+// 删除旧的hint文件之后再重命名覆盖原文件，hint文件会在下次Open时重建。
+func (b *Bitcask) migrateDataFile(fileID int64) error {
+	path := b.getDataFilePath(fileID)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	version := uint16(0)
+	options := b.dataFileOptions() // 没有文件头的旧文件按配置判断是否压缩
+	if buf, _ := reader.Peek(fileHeaderSize); bytes.HasPrefix(buf, fileMagic) {
+		h, err := decodeFileHeader(buf, fileKindData)
+		if err == nil {
+			return nil // 已经是当前格式
+		}
+		if err != ErrMigrationRequired {
+			return err
+		}
+		version = h.version
+		options = h.options
+		if _, err := reader.Discard(fileHeaderSize); err != nil {
+			return err
+		}
+	}
+
+	tmpPath := path + ".migrate"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	if _, err := w.Write(encodeFileHeader(fileHeader{version: formatVersion, kind: fileKindData, options: options})); err != nil {
+		return err
+	}
+
+	offset := int64(0)
+	if version > 0 {
+		offset = fileHeaderSize
+	}
+	for {
+		h, key, value, size, err := readLegacyRecord(reader, version, options)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			// 旧文件末尾不完整的记录直接丢弃
+			b.config.Logger.Printf("discarded torn record at offset %d while migrating data file %d", offset, fileID)
+			break
+		}
+		if err == errLegacyChecksum {
+			return &CorruptError{FileID: fileID, Offset: offset}
+		}
+		if err != nil {
+			return err
+		}
+		offset += size
+
+		if _, err := w.Write(encodeRecord(h, string(key), value)); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Remove(b.getHintFilePath(fileID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	b.config.Logger.Printf("migrated data file %d from format version %d to %d", fileID, version, formatVersion)
+	return nil
+}
+
+// errLegacyChecksum 表示旧格式记录的CRC校验失败
+var errLegacyChecksum = errors.New("legacy record checksum mismatch")
+
+// readLegacyRecord 按指定的旧格式版本读取一条记录并校验CRC，返回转换成当前格式的记录头、key、value
+// 以及这条记录在旧文件中占用的字节数。旧格式中的值按文件的压缩选项编码。
+func readLegacyRecord(r *bufio.Reader, version uint16, fileOptions byte) (recordHeader, []byte, []byte, int64, error) {
+	var hdrSize int
+	switch version {
+	case 0:
+		hdrSize = legacyHeaderSize
+	case 1:
+		hdrSize = 29 // 4(crc) + 8(timestamp) + 4(keySize) + 4(valueSize) + 1(type) + 8(batchID)
+	case 2:
+		hdrSize = 30 // 4(crc) + 8(timestamp) + 4(keySize) + 4(valueSize) + 1(type) + 1(codec) + 8(batchID)
+	default:
+		return recordHeader{}, nil, nil, 0, fmt.Errorf("%w: version %d", ErrUnsupportedVersion, version)
+	}
+
+	header := make([]byte, hdrSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return recordHeader{}, nil, nil, 0, err
+	}
+	h := recordHeader{
+		timestamp:  int64(binary.BigEndian.Uint64(header[4:12])),
+		recordType: recordTypeValue,
+	}
+	keySize := binary.BigEndian.Uint32(header[12:16])
+	valueSize := binary.BigEndian.Uint32(header[16:20])
+	switch version {
+	case 1:
+		h.recordType = header[20]
+		h.batchID = binary.BigEndian.Uint64(header[21:29])
+	case 2:
+		h.recordType = header[20]
+		h.codec = header[21]
+		h.batchID = binary.BigEndian.Uint64(header[22:30])
+	}
+
+	data := make([]byte, int(keySize)+int(valueSize))
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return recordHeader{}, nil, nil, 0, err
+	}
+	key, value := data[:keySize], data[keySize:]
+	size := int64(hdrSize) + int64(len(data))
+
+	// 版本0的CRC只覆盖key和value，之后的版本覆盖crc之后的全部内容
+	crc := crc32.Update(crc32.ChecksumIEEE(key), crc32.IEEETable, value)
+	if version > 0 {
+		crc = crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, data)
+	}
+	if crc != binary.BigEndian.Uint32(header[:4]) {
+		return recordHeader{}, nil, nil, size, errLegacyChecksum
+	}
+
+	// 版本2起每条记录保存自己的编码，之前的版本按文件的压缩选项编码
+	if version == 2 {
+		return h, key, value, size, nil
+	}
+
+	compressed := fileOptions&optionCompressed != 0
+	if h.recordType == recordTypeValue && compressed {
+		h.codec = CodecZlib
+	}
+
+	// 版本0没有记录类型，Delete写入的是空值
+	if version == 0 {
+		if len(value) == 0 {
+			h.recordType = recordTypeTombstone
+			h.codec = CodecNone
+		} else if compressed {
+			if raw, err := ZlibCodec.Decode(value); err == nil && len(raw) == 0 {
+				h.recordType = recordTypeTombstone
+				h.codec = CodecNone
+				value = nil
+			}
+		}
+	}
+
+	return h, key, value, size, nil
+}
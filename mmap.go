@@ -0,0 +1,150 @@
+package bitcask
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapFile 以只读方式映射file，返回的映射带有一个引用。length大于文件大小时预留更大的映射区域，
+// 文件之后追加的数据不需要重新映射就能读到，但只有前size个字节可以访问，超出文件末尾的部分会触发SIGBUS。
+// 映射建立之后不再依赖文件句柄，调用方可以关闭它。
+func mapFile(file *os.File, length int64) (*MmapedFile, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if length < fi.Size() {
+		length = fi.Size()
+	}
+
+	mf := &MmapedFile{data: []byte{}, size: fi.Size(), refs: 1}
+	if length > 0 {
+		data, err := unix.Mmap(int(file.Fd()), 0, int(length), unix.PROT_READ, unix.MAP_SHARED)
+		if err != nil {
+			return nil, err
+		}
+		mf.data = data
+	}
+	return mf, nil
+}
+
+// bytes 返回映射中已经写入文件的部分
+func (mf *MmapedFile) bytes() []byte {
+	return mf.data[:mf.size]
+}
+
+// acquire 增加一个引用，持有引用期间映射不会被解除
+func (mf *MmapedFile) acquire() {
+	atomic.AddInt32(&mf.refs, 1)
+}
+
+// release 释放一个引用，最后一个引用释放时解除映射
+func (mf *MmapedFile) release() error {
+	if atomic.AddInt32(&mf.refs, -1) > 0 {
+		return nil
+	}
+	data := mf.data
+	mf.data = nil
+	if len(data) == 0 {
+		return nil
+	}
+	return unix.Munmap(data)
+}
+
+// updateMmap 映射已封存的数据文件，调用方需持有写锁
+func (b *Bitcask) updateMmap(fileID int64) error {
+	file, err := os.Open(b.getDataFilePath(fileID))
+	if err != nil {
+		return fmt.Errorf("failed to open data file for mmap: %w", err)
+	}
+	defer file.Close()
+
+	mf, err := mapFile(file, 0)
+	if err != nil {
+		return fmt.Errorf("failed to mmap file: %w", err)
+	}
+	return b.installMmap(fileID, mf)
+}
+
+// mapActiveFile 为活动文件建立预留MaxFileSize的映射，追加写入之后不需要重新映射
+func (b *Bitcask) mapActiveFile() error {
+	mf, err := mapFile(b.activeFile, b.config.MaxFileSize)
+	if err != nil {
+		return fmt.Errorf("failed to mmap active file: %w", err)
+	}
+	return b.installMmap(b.activeFileID, mf)
+}
+
+// installMmap 用mf替换数据文件当前的映射。mmapedFiles持有当前映射的一个引用，
+// 被替换的旧映射在读者、迭代器和快照都释放它之后才解除。
+func (b *Bitcask) installMmap(fileID int64, mf *MmapedFile) error {
+	old, ok := b.mmapedFiles[fileID]
+	if ok {
+		mf.header = old.header
+	} else {
+		// 第一次映射时校验文件头，旧格式或无法识别的版本直接拒绝打开
+		header, err := decodeFileHeader(mf.bytes(), fileKindData)
+		if err != nil {
+			mf.release()
+			return err
+		}
+		mf.header = header
+	}
+
+	b.mmapedFiles[fileID] = mf
+	if ok {
+		old.release()
+	}
+	return nil
+}
+
+// activeFileSize 返回活动文件的大小，包括还在写缓冲中的记录
+func (b *Bitcask) activeFileSize() int64 {
+	mf, ok := b.mmapedFiles[b.activeFileID]
+	if b.activeFile == nil || !ok {
+		return 0
+	}
+	return mf.size + int64(len(b.writeBuf))
+}
+
+// extendActiveFile 记录活动文件新追加的n个字节。只有单条记录超过MaxFileSize，
+// 写入的数据超出预留的映射区域时才需要重新映射。
+func (b *Bitcask) extendActiveFile(n int64) error {
+	mf := b.mmapedFiles[b.activeFileID]
+	if mf.size+n <= int64(len(mf.data)) {
+		mf.size += n
+		return nil
+	}
+	return b.mapActiveFile()
+}
+
+// removeMmap 从mmapedFiles中移除数据文件并释放它的映射，调用方需持有写锁
+func (b *Bitcask) removeMmap(fileID int64) error {
+	mf, ok := b.mmapedFiles[fileID]
+	if !ok {
+		return nil
+	}
+	delete(b.mmapedFiles, fileID)
+	return mf.release()
+}
+
+// pinFiles 为所有数据文件当前的映射各增加一个引用，之后即使文件被合并删除或重新映射，
+// 这些映射仍然可以读取。调用方需持有锁，使用完毕后调用unpinFiles。
+func (b *Bitcask) pinFiles() map[int64]*MmapedFile {
+	files := make(map[int64]*MmapedFile, len(b.mmapedFiles))
+	for fileID, mf := range b.mmapedFiles {
+		mf.acquire()
+		files[fileID] = mf
+	}
+	return files
+}
+
+// unpinFiles 释放pinFiles增加的引用
+func unpinFiles(files map[int64]*MmapedFile) {
+	for _, mf := range files {
+		mf.release()
+	}
+}
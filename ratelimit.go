@@ -0,0 +1,114 @@
+package bitcask
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter 是合并、快照等后台任务共享的令牌桶，按字节限制读写速度。
+// 单次请求可以超过桶的容量，超出的部分记为欠账，由之后的请求等待偿还。
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // 每秒字节数，0表示不限速
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst int64) *rateLimiter {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &rateLimiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill 按经过的时间补充令牌，调用方需持有锁
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// wait 获取n个字节的令牌，令牌不足时等待，ctx取消时返回错误并归还令牌
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || l.rate <= 0 || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+	if deficit <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens += float64(n)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// available 返回当前可以立即使用的字节数
+func (l *rateLimiter) available() int64 {
+	if l == nil || l.rate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	if l.tokens < 0 {
+		return 0
+	}
+	return int64(l.tokens)
+}
+
+// chunk 返回一次最多可以申请的字节数，不超过桶的容量
+func (l *rateLimiter) chunk(n int) int {
+	if l == nil || l.rate <= 0 || l.burst < 1 || float64(n) <= l.burst {
+		return n
+	}
+	return int(l.burst)
+}
+
+// limitedWriter 在每次写入之前从限速器获取令牌
+type limitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+// Write 把p拆成不超过桶容量的块，每块单独等待令牌，避免一次大写入等待之后集中写出
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := lw.limiter.chunk(len(p))
+		if err := lw.limiter.wait(lw.ctx, chunk); err != nil {
+			return written, err
+		}
+		n, err := lw.w.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
@@ -0,0 +1,83 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// 记录类型
+const (
+	recordTypeValue       byte = 0
+	recordTypeBatchCommit byte = 1
+	recordTypeTombstone   byte = 2
+)
+
+// recordHeader is the fixed-size header in front of every record in a data file.
+type recordHeader struct {
+	crc        uint32
+	timestamp  int64
+	keySize    uint32
+	valueSize  uint32
+	recordType byte
+	codec      byte
+	batchID    uint64
+	expiry     int64 // 过期时间（UnixNano），0表示不过期
+}
+
+// size returns the total on-disk size of the record described by h.
+func (h recordHeader) size() int64 {
+	return int64(headerSize) + int64(h.keySize) + int64(h.valueSize)
+}
+
+// encodeRecord serializes a record, filling in sizes and the checksum.
+// The CRC covers everything after the crc field: header, key and value.
+func encodeRecord(h recordHeader, key string, value []byte) []byte {
+	h.keySize = uint32(len(key))
+	h.valueSize = uint32(len(value))
+
+	buf := make([]byte, h.size())
+	binary.BigEndian.PutUint64(buf[4:12], uint64(h.timestamp))
+	binary.BigEndian.PutUint32(buf[12:16], h.keySize)
+	binary.BigEndian.PutUint32(buf[16:20], h.valueSize)
+	buf[20] = h.recordType
+	buf[21] = h.codec
+	binary.BigEndian.PutUint64(buf[22:30], h.batchID)
+	binary.BigEndian.PutUint64(buf[30:38], uint64(h.expiry))
+	copy(buf[headerSize:], key)
+	copy(buf[headerSize+len(key):], value)
+
+	binary.BigEndian.PutUint32(buf[:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// decodeRecordHeader parses a record header from buf, which must hold at least headerSize bytes.
+func decodeRecordHeader(buf []byte) recordHeader {
+	return recordHeader{
+		crc:        binary.BigEndian.Uint32(buf[:4]),
+		timestamp:  int64(binary.BigEndian.Uint64(buf[4:12])),
+		keySize:    binary.BigEndian.Uint32(buf[12:16]),
+		valueSize:  binary.BigEndian.Uint32(buf[16:20]),
+		recordType: buf[20],
+		codec:      buf[21],
+		batchID:    binary.BigEndian.Uint64(buf[22:30]),
+		expiry:     int64(binary.BigEndian.Uint64(buf[30:38])),
+	}
+}
+
+// validChecksum reports whether the CRC stored in a complete encoded record matches its contents.
+func validChecksum(record []byte) bool {
+	return binary.BigEndian.Uint32(record[:4]) == crc32.ChecksumIEEE(record[4:])
+}
+
+// validRecordAfter reports whether a complete record with a valid checksum starts
+// anywhere in buf after its first byte. It tells a torn tail, after which nothing
+// valid was written, apart from a damaged record in the middle of a file.
+func validRecordAfter(buf []byte) bool {
+	for i := 1; i+headerSize <= len(buf); i++ {
+		h := decodeRecordHeader(buf[i:])
+		if end := int64(i) + h.size(); end <= int64(len(buf)) && validChecksum(buf[i:end]) {
+			return true
+		}
+	}
+	return false
+}
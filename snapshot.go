@@ -0,0 +1,182 @@
+package bitcask
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReadSnapshot is a consistent, read-only view of the database at the moment
+// it was created. Writes, deletes, expirations and merges made afterwards are
+// not visible through it. Creating a snapshot is cheap: with the default
+// NewBTreeIndex later writes copy only the parts of the key index they change,
+// while with NewHashIndex the next write copies the whole index once.
+//
+// A ReadSnapshot keeps the data files it reads from alive, so it should be
+// released with Release when it is no longer needed. It is safe for concurrent use.
+type ReadSnapshot struct {
+	db     *Bitcask
+	keydir Index
+	files  map[int64]*MmapedFile
+	sizes  map[int64]int64 // 创建快照时每个文件已写入的字节数
+	at     int64           // 创建快照的时间，用于判断过期
+
+	mu       sync.RWMutex
+	released bool
+}
+
+// NewReadSnapshot captures the current state of the database.
+func (b *Bitcask) NewReadSnapshot() (*ReadSnapshot, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	// 快照只从映射中读取，先把写缓冲写入文件
+	if !b.config.ReadOnly && b.activeFile != nil {
+		if err := b.flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &ReadSnapshot{
+		db:     b,
+		keydir: b.keydir.Clone(),
+		files:  b.pinFiles(),
+		at:     time.Now().UnixNano(),
+	}
+	s.sizes = make(map[int64]int64, len(s.files))
+	for fileID, mf := range s.files {
+		s.sizes[fileID] = mf.size
+	}
+	return s, nil
+}
+
+// Get retrieves the value key had when the snapshot was created. The returned
+// slice is a copy owned by the caller.
+func (s *ReadSnapshot) Get(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.released {
+		return nil, ErrClosed
+	}
+
+	e, ok := s.keydir.Get(key)
+	if !ok || e.expired(s.at) {
+		return nil, ErrKeyNotFound
+	}
+	return s.value(key, e)
+}
+
+// read 在持有读锁的情况下读取e指向的值
+func (s *ReadSnapshot) read(key string, e Entry) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.released {
+		return nil, ErrClosed
+	}
+	return s.value(key, e)
+}
+
+// value 返回e指向的值的副本，调用方需持有读锁并确认快照没有释放
+func (s *ReadSnapshot) value(key string, e Entry) ([]byte, error) {
+	h, value, err := s.readRecord(key, e)
+	if err != nil {
+		return nil, err
+	}
+	if h.codec == CodecNone {
+		return append([]byte(nil), value...), nil
+	}
+	return decodeValue(h.codec, value)
+}
+
+// Scan calls fn in key order for every key in the range [start, end) with its
+// value as of the snapshot. An empty end means no upper bound. The value is
+// only valid until fn returns and must not be modified. Scan stops at the
+// first error returned by fn and returns it.
+func (s *ReadSnapshot) Scan(start, end string, fn func(key string, value []byte) error) error {
+	return s.scan(start, func(key string) bool { return end == "" || key < end }, fn)
+}
+
+// ScanPrefix calls fn in key order for every key that starts with prefix. It
+// follows the same rules as Scan.
+func (s *ReadSnapshot) ScanPrefix(prefix string, fn func(key string, value []byte) error) error {
+	return s.scan(prefix, func(key string) bool { return strings.HasPrefix(key, prefix) }, fn)
+}
+
+// scan 从from开始按顺序读取key，直到in返回false
+func (s *ReadSnapshot) scan(from string, in func(key string) bool, fn func(key string, value []byte) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.released {
+		return ErrClosed
+	}
+
+	var err error
+	s.keydir.Ascend(from, func(key string, e Entry) bool {
+		if !in(key) {
+			return false
+		}
+		if e.expired(s.at) {
+			return true
+		}
+		var h recordHeader
+		var value []byte
+		if h, value, err = s.readRecord(key, e); err != nil {
+			return false
+		}
+		if value, err = decodeValue(h.codec, value); err != nil {
+			return false
+		}
+		err = fn(key, value)
+		return err == nil
+	})
+	return err
+}
+
+// readRecord 从快照持有的映射中读取e指向的记录，返回记录头和未解码的值
+func (s *ReadSnapshot) readRecord(key string, e Entry) (recordHeader, []byte, error) {
+	mf, ok := s.files[e.fileID]
+	if !ok {
+		return recordHeader{}, nil, fmt.Errorf("mmap file not found for file ID %d", e.fileID)
+	}
+	return s.db.recordAt(mf.data[:s.sizes[e.fileID]], 0, key, e)
+}
+
+// Release frees the snapshot. Reads through it fail with ErrClosed afterwards.
+// It must not be called from within a Scan callback.
+func (s *ReadSnapshot) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	unpinFiles(s.files)
+}
+
+// Scan calls fn in key order for every key in the range [start, end). An empty
+// end means no upper bound. The keys and values are read from a snapshot taken
+// when Scan starts, so fn may call other methods, including writes. The value
+// is only valid until fn returns and must not be modified.
+func (b *Bitcask) Scan(start, end string, fn func(key string, value []byte) error) error {
+	s, err := b.NewReadSnapshot()
+	if err != nil {
+		return err
+	}
+	defer s.Release()
+	return s.Scan(start, end, fn)
+}
+
+// ScanPrefix calls fn in key order for every key that starts with prefix. It
+// follows the same rules as Scan.
+func (b *Bitcask) ScanPrefix(prefix string, fn func(key string, value []byte) error) error {
+	s, err := b.NewReadSnapshot()
+	if err != nil {
+		return err
+	}
+	defer s.Release()
+	return s.ScanPrefix(prefix, fn)
+}
@@ -0,0 +1,177 @@
+package bitcask
+
+import (
+	"sort"
+	"time"
+)
+
+// fileStat 记录一个数据文件中的记录总字节数和仍被keydir引用的字节数，两者之差就是可以通过合并回收的空间。
+// 有过期时间的值单独统计，文件中最晚的过期时间过去之后它们都可以回收。
+// 墓碑记录也单独统计，只要还有更旧的文件，合并时就可能需要保留它们。
+type fileStat struct {
+	size       int64
+	live       int64
+	expiring   int64
+	expiresBy  int64
+	tombstones int64
+}
+
+// Stats describes the state of a Bitcask database.
+type Stats struct {
+	Keys      int
+	DataFiles int
+	Files     []FileStats
+
+	// BackgroundIORate is the configured limit for merge and snapshot I/O in
+	// bytes per second, or 0 if unlimited. BackgroundIOBudget is the number of
+	// bytes background jobs can use right now without waiting.
+	BackgroundIORate   int64
+	BackgroundIOBudget int64
+
+	// Syncs is the number of times the active data file has been fsynced.
+	Syncs int64
+}
+
+// FileStats describes the space usage of a single data file. DeadBytes counts
+// overwritten values, deleted values, tombstones and other records that a merge reclaims.
+// Values with a TTL count as dead once all of them in the file have expired.
+type FileStats struct {
+	FileID    int64
+	Size      int64
+	LiveBytes int64
+	DeadBytes int64
+}
+
+// Ratio returns the fraction of the file taken up by dead bytes.
+func (fs FileStats) Ratio() float64 {
+	if fs.Size == 0 {
+		return 0
+	}
+	return float64(fs.DeadBytes) / float64(fs.Size)
+}
+
+// Stats returns the number of keys and per-file space usage, ordered by file ID.
+func (b *Bitcask) Stats() Stats {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	stats := Stats{
+		Keys:               b.keydir.Len(),
+		DataFiles:          len(b.mmapedFiles),
+		BackgroundIORate:   b.config.BackgroundIORate,
+		BackgroundIOBudget: b.ioLimiter.available(),
+		Syncs:              b.syncs,
+	}
+	for fileID := range b.mmapedFiles {
+		stats.Files = append(stats.Files, b.fileStats(fileID))
+	}
+	sort.Slice(stats.Files, func(i, j int) bool { return stats.Files[i].FileID < stats.Files[j].FileID })
+	return stats
+}
+
+// fileStats 返回一个数据文件的空间统计，调用方需持有锁
+func (b *Bitcask) fileStats(fileID int64) FileStats {
+	fs := FileStats{FileID: fileID}
+	if st, ok := b.fileStat[fileID]; ok {
+		fs.Size = st.size
+		fs.LiveBytes = st.live
+		fs.DeadBytes = st.size - st.live
+		if st.expiring > 0 && st.expiresBy <= time.Now().UnixNano() {
+			fs.LiveBytes -= st.expiring
+			fs.DeadBytes += st.expiring
+		}
+	}
+	return fs
+}
+
+// recordSize 返回key对应记录在数据文件中占用的字节数
+func recordSize(key string, e Entry) int64 {
+	return int64(headerSize) + int64(len(key)) + int64(e.valueSize)
+}
+
+// stat 返回数据文件的空间统计，不存在时创建
+func (b *Bitcask) stat(fileID int64) *fileStat {
+	st, ok := b.fileStat[fileID]
+	if !ok {
+		st = &fileStat{}
+		b.fileStat[fileID] = st
+	}
+	return st
+}
+
+// setKey 更新keydir，被覆盖的旧记录计为无效字节
+func (b *Bitcask) setKey(key string, e Entry) {
+	b.deleteKey(key)
+	b.keydir.Set(key, e)
+	st := b.stat(e.fileID)
+	st.live += recordSize(key, e)
+	if e.expiry != 0 {
+		st.expiring += recordSize(key, e)
+		if e.expiry > st.expiresBy {
+			st.expiresBy = e.expiry
+		}
+	}
+}
+
+// deleteKey 从keydir中删除key，它的记录计为无效字节
+func (b *Bitcask) deleteKey(key string) {
+	old, ok := b.keydir.Get(key)
+	if !ok {
+		return
+	}
+	b.keydir.Delete(key)
+	if st, ok := b.fileStat[old.fileID]; ok {
+		st.live -= recordSize(key, old)
+		if old.expiry != 0 {
+			st.expiring -= recordSize(key, old)
+			if st.expiring == 0 {
+				st.expiresBy = 0
+			}
+		}
+	}
+}
+
+// addTombstone 记录fileID中新写入的一条墓碑记录，调用方需持有写锁
+func (b *Bitcask) addTombstone(fileID int64, key string) {
+	b.stat(fileID).tombstones += int64(headerSize) + int64(len(key))
+}
+
+// pickMergeFiles 按碎片率选择需要合并的已封存文件，调用方需持有锁。
+// 只有被选中文件的可回收字节总数达到MergeMinReclaimable时才返回结果。
+// force为true时选择所有包含可回收字节的已封存文件。
+// 除了最旧的文件，墓碑记录在合并时可能需要保留，不计入可回收字节，
+// 否则只有墓碑的文件每次合并都会被原样重写。
+func (b *Bitcask) pickMergeFiles(force bool) []int64 {
+	oldest := b.activeFileID
+	for fileID := range b.mmapedFiles {
+		if fileID < oldest {
+			oldest = fileID
+		}
+	}
+
+	var picked []int64
+	var reclaimable int64
+	for fileID := range b.mmapedFiles {
+		if fileID == b.activeFileID {
+			continue
+		}
+		fs := b.fileStats(fileID)
+		dead := fs.DeadBytes
+		if st, ok := b.fileStat[fileID]; ok && fileID != oldest {
+			dead -= st.tombstones
+		}
+		if dead <= 0 {
+			continue
+		}
+		if force || float64(dead)/float64(fs.Size) >= b.config.MergeRatio {
+			picked = append(picked, fileID)
+			reclaimable += dead
+		}
+	}
+
+	if len(picked) == 0 || (!force && reclaimable < b.config.MergeMinReclaimable) {
+		return nil
+	}
+	sort.Slice(picked, func(i, j int) bool { return picked[i] < picked[j] })
+	return picked
+}
@@ -0,0 +1,173 @@
+package bitcask
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type syncMode int
+
+const (
+	syncNever syncMode = iota
+	syncAlways
+	syncInterval
+	syncBytes
+)
+
+// SyncPolicy decides when buffered writes are flushed to the active data file
+// and fsynced. Whatever the policy, Sync and Close flush and fsync everything
+// written so far.
+type SyncPolicy struct {
+	mode     syncMode
+	interval time.Duration
+	bytes    int64
+}
+
+// SyncAlways flushes and fsyncs every write before it returns. Concurrent
+// writes are committed in groups that share a single fsync.
+func SyncAlways() SyncPolicy {
+	return SyncPolicy{mode: syncAlways}
+}
+
+// SyncEvery flushes and fsyncs buffered writes from a background goroutine
+// once per interval. Writes made since the last sync can be lost in a crash.
+// Open fails if interval is not positive.
+func SyncEvery(interval time.Duration) SyncPolicy {
+	return SyncPolicy{mode: syncInterval, interval: interval}
+}
+
+// SyncEveryBytes flushes and fsyncs once n bytes have been written since the
+// last sync. Open fails if n is not positive.
+func SyncEveryBytes(n int64) SyncPolicy {
+	return SyncPolicy{mode: syncBytes, bytes: n}
+}
+
+// SyncNever leaves fsync to the operating system. Buffered writes are flushed
+// when the write buffer fills up, and are lost if the process crashes before that.
+func SyncNever() SyncPolicy {
+	return SyncPolicy{mode: syncNever}
+}
+
+// validate 检查策略的参数，Open时调用
+func (p SyncPolicy) validate() error {
+	switch {
+	case p.mode == syncInterval && p.interval <= 0:
+		return fmt.Errorf("invalid sync policy: interval must be positive, got %v", p.interval)
+	case p.mode == syncBytes && p.bytes <= 0:
+		return fmt.Errorf("invalid sync policy: byte threshold must be positive, got %d", p.bytes)
+	}
+	return nil
+}
+
+// Sync flushes buffered writes to the active data file and fsyncs it.
+func (b *Bitcask) Sync() error {
+	if b.config.ReadOnly {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+
+	return b.syncActiveFile()
+}
+
+// flush 把写缓冲中的记录写入活动文件，调用方需持有写锁
+func (b *Bitcask) flush() error {
+	if len(b.writeBuf) == 0 {
+		return nil
+	}
+
+	n, err := b.activeFile.Write(b.writeBuf)
+	if n > 0 {
+		// 已经写入文件的部分可以通过映射读取
+		b.writeBuf = b.writeBuf[:copy(b.writeBuf, b.writeBuf[n:])]
+		if err := b.extendActiveFile(int64(n)); err != nil {
+			return fmt.Errorf("failed to update mmap: %w", err)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+	return nil
+}
+
+// syncActiveFile 把写缓冲写入活动文件并落盘，调用方需持有写锁
+func (b *Bitcask) syncActiveFile() error {
+	if b.activeFile == nil {
+		return nil
+	}
+	if err := b.flush(); err != nil {
+		return err
+	}
+	if err := b.activeFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	b.unsynced = 0
+	b.syncs++
+	return nil
+}
+
+// afterWrite 在记录追加到写缓冲之后按同步策略写入文件和落盘，调用方需持有写锁
+func (b *Bitcask) afterWrite(n int) error {
+	b.unsynced += int64(n)
+
+	// SyncAlways策略由组提交在一组写操作之后统一落盘
+	policy := b.config.SyncPolicy
+	switch {
+	case policy.mode == syncBytes && b.unsynced >= policy.bytes:
+		return b.syncActiveFile()
+	case len(b.writeBuf) >= b.config.WriteBufferSize:
+		return b.flush()
+	}
+	return nil
+}
+
+// buffered 判断e指向的记录是否还在写缓冲中，调用方需持有锁
+func (b *Bitcask) buffered(e Entry) bool {
+	mf, ok := b.mmapedFiles[e.fileID]
+	return ok && e.fileID == b.activeFileID && e.valuePos > mf.size
+}
+
+// startSyncer 按SyncEvery策略启动后台落盘，Close时取消ctx并等待它退出
+func (b *Bitcask) startSyncer() {
+	policy := b.config.SyncPolicy
+	if policy.mode != syncInterval {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.stopSync = cancel
+	b.syncWG.Add(1)
+	go func() {
+		defer b.syncWG.Done()
+		b.periodicSync(ctx, policy.interval)
+	}()
+}
+
+// periodicSync 定期把写缓冲写入活动文件并落盘
+func (b *Bitcask) periodicSync(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		b.mutex.Lock()
+		var err error
+		if b.unsynced > 0 {
+			err = b.syncActiveFile()
+		}
+		b.mutex.Unlock()
+		if err != nil {
+			b.config.Logger.Printf("sync failed: %v", err)
+		}
+	}
+}
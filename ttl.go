@@ -0,0 +1,68 @@
+package bitcask
+
+import "time"
+
+// PutWithTTL inserts a key-value pair that expires after ttl. Once expired the
+// key is reported as missing and its record is dropped by the next merge of
+// its data file. A ttl of zero or less stores the value without expiry.
+func (b *Bitcask) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return b.commit(func() error {
+		return b.put(key, value, ttl)
+	})
+}
+
+// Expire sets key to expire after ttl, replacing any previous expiry. A ttl of
+// zero or less removes the expiry. It returns ErrKeyNotFound if the key does
+// not exist or has already expired.
+func (b *Bitcask) Expire(key string, ttl time.Duration) error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return b.commit(func() error {
+		now := time.Now().UnixNano()
+		e, ok := b.keydir.Get(key)
+		if !ok || e.expired(now) {
+			return ErrKeyNotFound
+		}
+
+		// 过期时间保存在记录头中，原样复制编码后的值写一条新记录
+		h, value, err := b.readRecord(key, e)
+		if err != nil {
+			return err
+		}
+		return b.writeValue(key, recordHeader{timestamp: now, recordType: recordTypeValue, codec: h.codec, expiry: expiryAt(now, ttl)}, value)
+	})
+}
+
+// TTL returns how long key has left before it expires, or zero if it has no
+// expiry. It returns ErrKeyNotFound if the key does not exist or has expired.
+func (b *Bitcask) TTL(key string) (time.Duration, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.closed {
+		return 0, ErrClosed
+	}
+
+	now := time.Now().UnixNano()
+	e, ok := b.keydir.Get(key)
+	if !ok || e.expired(now) {
+		return 0, ErrKeyNotFound
+	}
+	if e.expiry == 0 {
+		return 0, nil
+	}
+	return time.Duration(e.expiry - now), nil
+}
+
+// expiryAt 返回从now开始ttl之后的过期时间，ttl不大于0时返回0表示不过期
+func expiryAt(now int64, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return now + int64(ttl)
+}
@@ -0,0 +1,109 @@
+package bitcask
+
+import "time"
+
+// Tx is a transaction started by Update or ViewTx. Writes are buffered in the
+// transaction and applied atomically when Update's function returns nil. A Tx
+// must not be used after its function returns or from several goroutines.
+type Tx struct {
+	db       *Bitcask
+	writable bool
+	reads    map[string]int64 // 读过的key在keydir中的时间戳，不存在时为0
+	writes   map[string]batchOp
+}
+
+// Update runs fn in a read-write transaction. If fn returns nil, its writes
+// are committed atomically; if fn returns an error, they are discarded and the
+// error is returned. The commit fails with ErrConflict if a key read by fn was
+// written or deleted by someone else after it was read.
+func (b *Bitcask) Update(fn func(tx *Tx) error) error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	tx := &Tx{db: b, writable: true, reads: make(map[string]int64), writes: make(map[string]batchOp)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// ViewTx runs fn in a read-only transaction. Put and Delete on the transaction
+// return ErrReadOnly.
+func (b *Bitcask) ViewTx(fn func(tx *Tx) error) error {
+	tx := &Tx{db: b, reads: make(map[string]int64)}
+	return fn(tx)
+}
+
+// Get returns the value of key, including writes made earlier in the same
+// transaction. The returned slice is a copy owned by the caller.
+func (tx *Tx) Get(key string) ([]byte, error) {
+	if op, ok := tx.writes[key]; ok {
+		if op.delete {
+			return nil, ErrKeyNotFound
+		}
+		return append([]byte(nil), op.value...), nil
+	}
+
+	b := tx.db
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	// 记录读到的版本，提交时据此检查冲突
+	if _, ok := tx.reads[key]; !ok {
+		tx.reads[key] = b.keyVersion(key, time.Now().UnixNano())
+	}
+	return b.get(key)
+}
+
+// Put sets key to value when the transaction commits.
+func (tx *Tx) Put(key string, value []byte) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	v := make([]byte, len(value))
+	copy(v, value)
+	tx.writes[key] = batchOp{key: key, value: v}
+	return nil
+}
+
+// Delete removes key when the transaction commits.
+func (tx *Tx) Delete(key string) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	tx.writes[key] = batchOp{key: key, delete: true}
+	return nil
+}
+
+// commit 检查读过的key没有被其他写者修改，然后把所有写操作作为一个批次写入
+func (tx *Tx) commit() error {
+	if len(tx.writes) == 0 {
+		return nil
+	}
+
+	ops := make([]batchOp, 0, len(tx.writes))
+	for _, op := range tx.writes {
+		ops = append(ops, op)
+	}
+
+	b := tx.db
+	return b.commit(func() error {
+		now := time.Now().UnixNano()
+		for key, version := range tx.reads {
+			if b.keyVersion(key, now) != version {
+				return ErrConflict
+			}
+		}
+		return b.commitBatch(ops)
+	})
+}
+
+// keyVersion 返回key当前的时间戳作为版本，不存在或已过期时返回0，调用方需持有锁
+func (b *Bitcask) keyVersion(key string, now int64) int64 {
+	e, ok := b.keydir.Get(key)
+	if !ok || e.expired(now) {
+		return 0
+	}
+	return e.timestamp
+}
@@ -1,7 +1,9 @@
 package bitcask
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"os"
 	"sync"
 )
@@ -10,29 +12,101 @@ type Bitcask struct {
 	directory    string
 	activeFile   *os.File
 	activeFileID int64
-	keydir       map[string]entry
+	keydir       Index
 	mutex        sync.RWMutex
 	config       *Config
 	mmapedFiles  map[int64]*MmapedFile
+	fileStat     map[int64]*fileStat
+	lockFile     *os.File
+	mergeMutex   sync.Mutex
+	stopMerge    context.CancelFunc
+	mergeWG      sync.WaitGroup
+	closed       bool
+	ioLimiter    *rateLimiter
+	writeBuf     []byte // 还没有写入活动文件的记录
+	unsynced     int64  // 上次落盘之后写入的字节数
+	stopSync     context.CancelFunc
+	syncWG       sync.WaitGroup
+	syncs        int64 // 活动文件落盘的次数
+	commitMu     sync.Mutex
+	commitQueue  []*commitRequest
+	committing   bool
 }
 
-type entry struct {
+// Entry records where the latest version of a key is stored. Index
+// implementations keep it as an opaque value and return it unchanged.
+type Entry struct {
 	valueSize int32
 	valuePos  int64
 	timestamp int64
 	fileID    int64
+	expiry    int64 // 过期时间（UnixNano），0表示不过期
+}
+
+// expired 判断e在now时是否已经过期
+func (e Entry) expired(now int64) bool {
+	return e.expiry != 0 && e.expiry <= now
+}
+
+// hintRecord 是hint文件中的一条记录，墓碑记录用于在恢复时屏蔽旧文件中的值
+type hintRecord struct {
+	Entry
+	recordType byte
 }
 
 type MmapedFile struct {
-	data []byte
-	file *os.File
+	data   []byte
+	size   int64 // 文件中已写入的字节数，活动文件的映射区域比它大
+	header fileHeader
+	refs   int32 // 引用计数，减到0时解除映射
 }
 
 const (
-	headerSize = 20 // 4(crc) + 8(timestamp) + 4(keySize) + 4(valueSize)
+	headerSize    = 38 // 4(crc) + 8(timestamp) + 4(keySize) + 4(valueSize) + 1(type) + 1(codec) + 8(batchID) + 8(expiry)
+	hintEntrySize = 41 // 4(keySize) + 4(valueSize) + 8(valuePos) + 8(timestamp) + 8(fileID) + 1(type) + 8(expiry)
 )
 
 var (
 	ErrKeyNotFound = errors.New("key not found")
 	ErrIOFailure   = errors.New("I/O operation failed")
+	ErrCorrupt     = errors.New("data corrupted")
+
+	// ErrDatabaseLocked is returned by Open when another process holds the database directory.
+	ErrDatabaseLocked = errors.New("database is locked by another process")
+
+	// ErrClosed is returned by reads, writes and Merge after the database has been closed.
+	ErrClosed = errors.New("database is closed")
+
+	// ErrReadOnly is returned by write operations on a database opened with
+	// ReadOnly and by writes in a transaction started with ViewTx.
+	ErrReadOnly = errors.New("database is read-only")
+
+	// ErrConflict is returned by Update when a key read by the transaction was
+	// changed by another writer before the transaction committed.
+	ErrConflict = errors.New("transaction conflict")
+
+	// ErrMigrationRequired is returned by Open when the directory contains files
+	// in an older format. Run Migrate to rewrite them.
+	ErrMigrationRequired = errors.New("data files use an older format, migration required")
+
+	// ErrUnsupportedVersion is returned by Open when a file was written by a newer, unknown format version.
+	ErrUnsupportedVersion = errors.New("unsupported file format version")
+
+	// ErrUnknownCodec is returned when a record was written with a codec that is not registered.
+	ErrUnknownCodec = errors.New("unknown codec")
 )
+
+// CorruptError reports a record whose checksum does not match its contents.
+// It matches ErrCorrupt with errors.Is.
+type CorruptError struct {
+	FileID int64
+	Offset int64
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("%v: record at offset %d in file %d", ErrCorrupt, e.Offset, e.FileID)
+}
+
+func (e *CorruptError) Unwrap() error {
+	return ErrCorrupt
+}